@@ -0,0 +1,179 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// Condition restricts a resource to hosts where a certain host fact
+// matches (or, if Negated, does not match) a glob pattern.  Conditions
+// are given in the disambiguator, like "20-server@hostname=web*", or in
+// the resource directory configuration.
+type Condition struct {
+	Fact    string
+	Pattern string
+	Negated bool
+	// Err is set instead of the other fields for a placeholder
+	// condition that stands in for invalid conditions, and is never
+	// met.
+	Err error
+}
+
+// String returns the condition in the syntax from which it was parsed.
+func (c Condition) String() string {
+	if c.Negated {
+		return c.Fact + "!=" + c.Pattern
+	}
+	return c.Fact + "=" + c.Pattern
+}
+
+// HostFacts contains the facts about the host that conditions are
+// evaluated against.
+type HostFacts map[string]string
+
+// ParseCondition parses a condition like "hostname=web*" or
+// "arch!=armv7*".
+func ParseCondition(input string) (Condition, error) {
+	var c Condition
+	idx := strings.IndexByte(input, '=')
+	if idx <= 0 {
+		return c, fmt.Errorf("malformed condition %q (expected \"fact=pattern\" or \"fact!=pattern\")", input)
+	}
+	c.Fact, c.Pattern = input[:idx], input[idx+1:]
+	if strings.HasSuffix(c.Fact, "!") {
+		c.Fact = strings.TrimSuffix(c.Fact, "!")
+		c.Negated = true
+	}
+	if !isKnownFact(c.Fact) {
+		return c, fmt.Errorf("unknown fact %q in condition %q (known facts: %s)", c.Fact, input, strings.Join(knownFacts, ", "))
+	}
+	if _, err := path.Match(c.Pattern, ""); err != nil {
+		return c, fmt.Errorf("malformed pattern in condition %q: %s", input, err.Error())
+	}
+	return c, nil
+}
+
+// Matches evaluates the condition against the given host facts.
+func (c Condition) Matches(facts HostFacts) bool {
+	if c.Err != nil {
+		return false
+	}
+	matched, _ := path.Match(c.Pattern, facts[c.Fact]) //pattern has been validated by ParseCondition
+	return matched != c.Negated
+}
+
+var knownFacts = []string{"arch", "hostname", "id"}
+
+func isKnownFact(fact string) bool {
+	for _, f := range knownFacts {
+		if f == fact {
+			return true
+		}
+	}
+	return false
+}
+
+// HostFacts collects the facts about the host that conditions can refer
+// to:
+//
+//	id       - the ID from os-release(5)
+//	hostname - the hostname (when HOLO_ROOT_DIR is set, from $HOLO_ROOT_DIR/etc/hostname)
+//	arch     - the machine hardware name, as reported by `uname -m`
+func (p FilesPlugin) HostFacts() HostFacts {
+	facts := make(HostFacts)
+
+	osRelease, err := readOsRelease(p.Runtime.RootDirPath)
+	if err == nil {
+		facts["id"] = osRelease["ID"]
+	}
+
+	//for a chroot, the hostname of the running system is not relevant
+	if filepath.Clean(p.Runtime.RootDirPath) == "/" {
+		facts["hostname"], _ = os.Hostname()
+	} else {
+		contents, err := ioutil.ReadFile(filepath.Join(p.Runtime.RootDirPath, "etc/hostname"))
+		if err == nil {
+			facts["hostname"] = strings.TrimSpace(string(contents))
+		}
+	}
+
+	var uname syscall.Utsname
+	if syscall.Uname(&uname) == nil {
+		var machine []byte
+		for _, c := range uname.Machine {
+			if c == 0 {
+				break
+			}
+			machine = append(machine, byte(c))
+		}
+		facts["arch"] = string(machine)
+	}
+
+	return facts
+}
+
+// conditionSuffixRx matches the part after an "@" in a disambiguator
+// that is a condition. Other parts containing "@" (like in
+// "20-mail@example.org") are just part of the disambiguator's name.
+var conditionSuffixRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*!?=`)
+
+// Conditions returns the conditions for the resources with the given
+// disambiguator, from both the disambiguator itself and the resource
+// directory configuration.
+func (p FilesPlugin) Conditions(disambiguator string) ([]Condition, error) {
+	var result []Condition
+	fields := strings.Split(disambiguator, "@")
+	for _, field := range fields[1:] {
+		if !conditionSuffixRx.MatchString(field) {
+			continue
+		}
+		c, err := ParseCondition(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Join(p.Runtime.ResourceDirPath, disambiguator), err.Error())
+		}
+		result = append(result, c)
+	}
+
+	cfg, err := p.ResourceDirConfig(disambiguator)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, cfg.conditions...), nil
+}
+
+// unmetCondition returns the first of the given conditions that is not
+// met by the host, or nil if all conditions are met.
+func unmetCondition(conditions []Condition, facts HostFacts) *Condition {
+	for _, c := range conditions {
+		if !c.Matches(facts) {
+			return &c
+		}
+	}
+	return nil
+}
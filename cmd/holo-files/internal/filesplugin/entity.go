@@ -23,10 +23,11 @@ package filesplugin
 import (
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 
+	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
 	"github.com/holocm/holo/lib/holo"
 )
 
@@ -36,9 +37,52 @@ import (
 type FilesEntity struct {
 	relPath   string
 	resources Resources
+	skipped   []skippedResource
+	owners    *packageOwners
 	plugin    FilesPlugin
 }
 
+// packageOwners finds the packages that own the targets of all entities
+// from one scan (see PackageOwnerFinder), and which of these targets the
+// package manager considers modified (see ModifiedFileFinder).  The
+// package manager is only queried when the first owner is requested,
+// and then for all targets at once.
+type packageOwners struct {
+	relPaths []string
+	owners   map[string]string
+	modified map[string]bool
+	queried  bool
+}
+
+func (o *packageOwners) find(entity *FilesEntity) (owner string, modified bool) {
+	if !o.queried {
+		o.queried = true
+		rootDir := entity.plugin.Runtime.RootDirPath
+		pm := GetPackageManager(rootDir, os.Stderr)
+		if finder, ok := pm.(PackageOwnerFinder); ok {
+			o.owners = finder.FindPackageOwners(rootDir, o.relPaths)
+		}
+		if finder, ok := pm.(ModifiedFileFinder); ok {
+			o.modified = finder.FindModifiedTargets(rootDir, o.owners)
+		}
+	}
+	return o.owners[entity.relPath], o.modified[entity.relPath]
+}
+
+// skippedResource is a resource whose conditions are not met on this
+// host.
+type skippedResource struct {
+	Resource
+	condition Condition
+}
+
+func (resource skippedResource) reason() string {
+	if resource.condition.Err != nil {
+		return "invalid configuration: " + resource.condition.Err.Error()
+	}
+	return "condition " + resource.condition.String() + " not met"
+}
+
 // NewFilesEntity creates a FilesEntity instance for which a path is
 // known.
 //
@@ -55,6 +99,34 @@ func (entity *FilesEntity) AddResource(entry Resource) {
 	entity.resources = append(entity.resources, entry)
 }
 
+// addSkippedResource registers a resource that is not applied because
+// its conditions are not met.  It is only shown to the user.
+func (entity *FilesEntity) addSkippedResource(entry Resource, condition Condition) {
+	entity.skipped = append(entity.skipped, skippedResource{entry, condition})
+}
+
+// isSkipped returns whether this entity has only skipped resources, and
+// does not need to be scrubbed either (because it was never
+// provisioned on this host).
+func (entity *FilesEntity) isSkipped() bool {
+	if len(entity.resources) > 0 || len(entity.skipped) == 0 || entity.isBroken() {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(entity.plugin.Runtime.StateDirPath, "base", entity.relPath))
+	return os.IsNotExist(err)
+}
+
+// isBroken returns whether the conditions of some resources of this
+// entity cannot be evaluated, which prevents applying the entity.
+func (entity *FilesEntity) isBroken() bool {
+	for _, resource := range entity.skipped {
+		if resource.condition.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Resources returns an ordered list of all resources for this
 // FilesEntity.
 func (entity *FilesEntity) Resources() []Resource {
@@ -71,6 +143,12 @@ func (entity *FilesEntity) EntityID() string {
 // applying this entity, and optionally a reason justifying that
 // action.
 func (entity *FilesEntity) EntityAction() (verb, reason string) {
+	if entity.isBroken() {
+		return "", ""
+	}
+	if entity.isSkipped() {
+		return "Skipping", "conditions not met"
+	}
 	if len(entity.resources) == 0 {
 		_, _, assessment := entity.scanOrphan()
 		return "Scrubbing", assessment
@@ -86,7 +164,7 @@ func (entity *FilesEntity) EntitySource() []string {
 	}
 	var ret []string
 	for _, resource := range entity.Resources() {
-		ret = append(ret, resource.Path)
+		ret = append(ret, resource.Path())
 	}
 	return ret
 }
@@ -94,27 +172,71 @@ func (entity *FilesEntity) EntitySource() []string {
 // EntityUserInfo returns a list of key/value pairs that will be shown
 // to the user during `holo scan`.
 func (entity *FilesEntity) EntityUserInfo() (r []holo.KV) {
-	if len(entity.resources) == 0 {
+	if entity.isSkipped() || (entity.isBroken() && len(entity.resources) == 0) {
+		//nothing to do but to show the skipped resources
+	} else if len(entity.resources) == 0 {
 		_, strategy, _ := entity.scanOrphan()
 		r = append(r, holo.KV{strategy, filepath.Join(entity.plugin.Runtime.StateDirPath, "base", entity.relPath)})
 	} else {
 		r = append(r, holo.KV{"store at", filepath.Join(entity.plugin.Runtime.StateDirPath, "base", entity.relPath)})
 		for _, resource := range entity.Resources() {
-			if strings.HasSuffix(resource.Path, ".holoscript") {
-				r = append(r, holo.KV{"passthru", resource.Path})
-			} else {
-				r = append(r, holo.KV{"apply", resource.Path})
-			}
+			r = append(r, holo.KV{resource.ApplicationStrategy(), resource.Path()})
 		}
 	}
+	for _, resource := range entity.skipped {
+		r = append(r, holo.KV{"skip", resource.Path() + " (" + resource.reason() + ")"})
+	}
+	if entity.owners != nil {
+		owner, modified := entity.owners.find(entity)
+		if owner != "" {
+			r = append(r, holo.KV{"owned by", owner})
+		}
+		// the package manager considers all targets modified that
+		// holo-files has changed, so only report modifications
+		// that are not from the last `holo apply`
+		if modified && !entity.isProvisioned() {
+			r = append(r, holo.KV{"modified", "according to the package manager"})
+		}
+	}
+	backups, _ := entity.Backups()
+	for _, timestamp := range backups {
+		r = append(r, holo.KV{"backup at", entity.backupPath(timestamp)})
+	}
 	return r
 }
 
-//Apply applies the entity.
+// isProvisioned returns whether the target is exactly as provisioned by
+// the last `holo apply`.
+func (entity *FilesEntity) isProvisioned() bool {
+	provisioned, err := entity.GetProvisioned()
+	if err != nil {
+		return false
+	}
+	current, err := entity.GetCurrent()
+	if err != nil {
+		return false
+	}
+	return current.EqualTo(provisioned)
+}
+
+//Apply applies the entity.  Errors are reported on stderr, and
+//result in an ApplyError.
 func (entity *FilesEntity) Apply(withForce bool, stdout, stderr io.Writer) holo.ApplyResult {
-	// BUG(lukeshu): FilesEntity.Apply: We hide errors here to
-	// match the upstream behavior of holo-files:
-	// https://github.com/holocm/holo/issues/19
+	entity.removeStrayFiles(stderr)
+
+	// do not apply anything if we cannot tell which resources apply
+	if entity.isBroken() {
+		for _, resource := range entity.skipped {
+			if resource.condition.Err != nil {
+				fmt.Fprintf(stderr, "!! %s\n", resource.condition.Err.Error())
+			}
+		}
+		return holo.ApplyError(1)
+	}
+
+	if entity.isSkipped() {
+		return holo.ApplyAlreadyApplied
+	}
 	switch len(entity.resources) {
 	case 0:
 		errs := entity.applyOrphan(stdout, stderr)
@@ -122,8 +244,7 @@ func (entity *FilesEntity) Apply(withForce bool, stdout, stderr io.Writer) holo.
 			for _, err := range errs {
 				fmt.Fprintf(stderr, "!! %s\n", err.Error())
 			}
-			//return holo.NewApplyError(errs[0])
-			return holo.ApplyApplied
+			return holo.ApplyError(1)
 		}
 		return holo.ApplyApplied
 	default:
@@ -131,10 +252,39 @@ func (entity *FilesEntity) Apply(withForce bool, stdout, stderr io.Writer) holo.
 
 		if err != nil {
 			fmt.Fprintf(stderr, "!! %s\n", err.Error())
-			//return holo.NewApplyError(err)
-			return holo.ApplyApplied
+			return holo.ApplyError(1)
 		}
 
 		return result
 	}
 }
+
+// removeStrayFiles removes files that were left behind when a previous
+// `holo apply` was interrupted (e.g. by a crash or power loss) while
+// writing one of the files of this entity.  Since all writes go through
+// a temporary file that is renamed into place, the files themselves
+// are always intact, and the stray files can just be removed.  This is
+// only done during apply, where holo holds its lock, so that the
+// temporary files of another running `holo apply` are not touched.
+func (entity *FilesEntity) removeStrayFiles(stderr io.Writer) {
+	paths := []string{
+		filepath.Join(entity.plugin.Runtime.RootDirPath, entity.relPath),
+		filepath.Join(entity.plugin.Runtime.StateDirPath, "base", entity.relPath),
+		filepath.Join(entity.plugin.Runtime.StateDirPath, "provisioned", entity.relPath),
+	}
+	for _, path := range paths {
+		strayPaths, err := fileutil.StrayFiles(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "!! %s\n", err.Error())
+			continue
+		}
+		for _, strayPath := range strayPaths {
+			err := fileutil.Remove(strayPath)
+			if err != nil {
+				fmt.Fprintf(stderr, "!! %s\n", err.Error())
+			} else {
+				fmt.Fprintf(stderr, ">> removed stray file %s (left over from an interrupted write)\n", strayPath)
+			}
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -77,7 +78,9 @@ func (entity *FilesEntity) applyNonOrphan(withForce bool, stdout, stderr io.Writ
 
 	// step 1: if we don't have a base yet, the file at current
 	// *is* the base which we have to copy now
+	firstApply := false
 	if !base.Manageable && current.Manageable {
+		firstApply = true
 		baseDir := filepath.Dir(base.Path)
 		err := os.MkdirAll(baseDir, 0755)
 		if err != nil {
@@ -88,9 +91,10 @@ func (entity *FilesEntity) applyNonOrphan(withForce bool, stdout, stderr io.Writ
 		if err != nil {
 			return nil, fmt.Errorf("Cannot copy %s to %s: %s", current.Path, base.Path, err.Error())
 		}
-		tmp := current
-		tmp.Path = base.Path
-		base = tmp
+		base, err = entity.GetBase()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if !base.Manageable {
@@ -116,8 +120,29 @@ func (entity *FilesEntity) applyNonOrphan(withForce bool, stdout, stderr io.Writ
 			return nil, fmt.Errorf("Cannot copy %s to %s: %v", newBase.Path, base.Path, err)
 		}
 		_ = os.Remove(newBase.Path) // this can fail silently
-		newBase.Path = base.Path
-		base = newBase
+		// (re-read the base, since newBase's contents were
+		// streamed from the file that was just removed)
+		base, err = entity.GetBase()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// step 3b: if possible, check that the target base is what
+	// the package manager installed (this is only done when the
+	// target base was just recorded, or when the user asks for it
+	// with --force, since it is quite expensive); differences are
+	// only reported, since replacing the target base would discard
+	// the local modifications for good (the user can do that with
+	// `holo-files adopt-base`)
+	if firstApply || withForce {
+		source, differs, err := entity.checkPristineBase(base, false, stderr)
+		if err != nil {
+			return nil, err
+		}
+		if differs {
+			fmt.Fprintf(stdout, ">> target base differs from packaged version in %s (use `holo-files adopt-base %s` to adopt the packaged version)\n", source, entity.EntityID())
+		}
 	}
 
 	// step 4: apply the resources *iff* the version at
@@ -144,6 +169,13 @@ func (entity *FilesEntity) applyNonOrphan(withForce bool, stdout, stderr io.Writ
 		if !withForce {
 			return holo.ApplyExternallyChanged, nil
 		}
+		// keep the manual changes around for `holo rollback`
+		if current.Manageable {
+			err = entity.backupCurrent(current, stdout)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// save a copy of the provisioned config file to check for
@@ -162,7 +194,14 @@ func (entity *FilesEntity) applyNonOrphan(withForce bool, stdout, stderr io.Writ
 
 	if !desired.EqualTo(current) {
 		// write the result buffer to the target and copy
-		// owners/permissions from base file to target file
+		// owners/permissions from base file to target file;
+		// extended attributes (SELinux labels, ACLs) are
+		// taken from the current target where it has them
+		// (it may have been relabeled since the base was
+		// recorded), and from the base otherwise
+		if desired.Mode.IsRegular() {
+			desired.Xattrs = mergeXattrs(current.Xattrs, desired.Xattrs)
+		}
 		newTargetPath := current.Path + ".holonew"
 		err = desired.Write(newTargetPath)
 		if err != nil {
@@ -171,7 +210,7 @@ func (entity *FilesEntity) applyNonOrphan(withForce bool, stdout, stderr io.Writ
 		// move $target.holonew -> $target atomically (to
 		// ensure that there is always a valid file at
 		// $target)
-		err = os.Rename(newTargetPath, current.Path)
+		err = fileutil.Rename(newTargetPath, current.Path)
 		if err != nil {
 			return nil, err
 		}
@@ -200,7 +239,7 @@ func (entity *FilesEntity) GetCurrent() (fileutil.FileBuffer, error) {
 //GetNewBase returns the base version of the entity, if it has been
 //updated by the package manager since last applied.
 func (entity *FilesEntity) GetNewBase(stdout, stderr io.Writer) (path string, buf fileutil.FileBuffer, err error) {
-	realPath, path, err := GetPackageManager(entity.plugin.Runtime.RootDirPath, stdout, stderr).FindUpdatedTargetBase(filepath.Join(entity.plugin.Runtime.RootDirPath, entity.relPath))
+	realPath, path, err := GetPackageManager(entity.plugin.Runtime.RootDirPath, stderr).FindUpdatedTargetBase(filepath.Join(entity.plugin.Runtime.RootDirPath, entity.relPath))
 	if err != nil {
 		return
 	}
@@ -211,6 +250,55 @@ func (entity *FilesEntity) GetNewBase(stdout, stderr io.Writer) (path string, bu
 	return
 }
 
+//checkPristineBase compares the target base with the version of the
+//target that was shipped by the system package, if the package manager
+//can provide it (see PristineBaseFinder).  This detects local
+//modifications that were made to the target before it was first
+//provisioned, and that thus ended up in the target base.  The source
+//of the packaged version is returned, or "" if it is not available.
+//If the target base differs from it, and adopt is true, the packaged
+//version is written into the target base.
+func (entity *FilesEntity) checkPristineBase(base fileutil.FileBuffer, adopt bool, stderr io.Writer) (source string, differs bool, err error) {
+	pm := GetPackageManager(entity.plugin.Runtime.RootDirPath, stderr)
+	finder, ok := pm.(PristineBaseFinder)
+	if !ok || !base.Mode.IsRegular() {
+		return "", false, nil
+	}
+
+	file, err := ioutil.TempFile(entity.plugin.Runtime.CacheDirPath, "pristine-")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.Remove(file.Name())
+	source, err = finder.FindPristineTargetBase(entity.plugin.Runtime.RootDirPath, entity.relPath, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// not being able to check is not a reason to fail
+		fmt.Fprintf(stderr, "!! Cannot read packaged version of %s: %s\n", entity.relPath, err.Error())
+		return "", false, nil
+	}
+	if source == "" {
+		return "", false, nil
+	}
+
+	// only the contents are compared; the metadata of the
+	// package's files is not taken from the package archive anyway
+	pristine := base
+	pristine.SetContentsFromFile(file.Name())
+	if pristine.EqualTo(base) {
+		return source, false, nil
+	}
+	if adopt {
+		err = pristine.Write(base.Path)
+		if err != nil {
+			return source, true, fmt.Errorf("Cannot copy %s to %s: %s", source, base.Path, err.Error())
+		}
+	}
+	return source, true, nil
+}
+
 //GetDesired applies all the resources for this FilesEntity onto the base.
 func (entity *FilesEntity) GetDesired(base fileutil.FileBuffer, stdout, stderr io.Writer) (fileutil.FileBuffer, error) {
 	resources := entity.Resources()
@@ -240,3 +328,20 @@ func (entity *FilesEntity) GetDesired(base fileutil.FileBuffer, stdout, stderr i
 
 	return buffer, nil
 }
+
+//mergeXattrs returns the union of both sets of extended attributes.
+//Where both sets contain the same attribute, the value from `primary`
+//wins.
+func mergeXattrs(primary, secondary map[string][]byte) map[string][]byte {
+	if len(secondary) == 0 {
+		return primary
+	}
+	result := make(map[string][]byte, len(primary)+len(secondary))
+	for name, value := range secondary {
+		result[name] = value
+	}
+	for name, value := range primary {
+		result[name] = value
+	}
+	return result
+}
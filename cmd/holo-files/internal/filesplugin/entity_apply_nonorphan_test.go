@@ -0,0 +1,56 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import "testing"
+
+func TestMergeXattrs(t *testing.T) {
+	//the current target has been relabeled since the target base was
+	//recorded, and has an ACL that the target base does not have
+	current := map[string][]byte{
+		"security.selinux":        []byte("system_u:object_r:etc_t:s0"),
+		"system.posix_acl_access": []byte("acl"),
+	}
+	base := map[string][]byte{
+		"security.selinux": []byte("system_u:object_r:user_home_t:s0"),
+		"user.origin":      []byte("package"),
+	}
+
+	merged := mergeXattrs(current, base)
+	expected := map[string]string{
+		"security.selinux":        "system_u:object_r:etc_t:s0",
+		"system.posix_acl_access": "acl",
+		"user.origin":             "package",
+	}
+	if len(merged) != len(expected) {
+		t.Errorf("expected %d extended attributes, got %d: %q", len(expected), len(merged), merged)
+	}
+	for name, value := range expected {
+		if string(merged[name]) != value {
+			t.Errorf("expected %s = %q, got %q", name, value, merged[name])
+		}
+	}
+
+	//with nothing to merge, the primary set is used as is
+	if merged := mergeXattrs(current, nil); len(merged) != len(current) {
+		t.Errorf("expected %d extended attributes, got %d: %q", len(current), len(merged), merged)
+	}
+}
@@ -43,8 +43,9 @@ func (entity *FilesEntity) scanOrphan() (targetPath, strategy, assessment string
 // applyOrphan cleans up an orphaned entity.
 func (entity *FilesEntity) applyOrphan(stdout, stderr io.Writer) []error {
 	_, strategy, _ := entity.scanOrphan()
-	basePath := filepath.Join(entity.plugin.Runtime.StateDirPath, "base", entity.relPath)
-	lastProvisionedPath := filepath.Join(entity.plugin.Runtime.StateDirPath, "provisioned", entity.relPath)
+	baseDir := filepath.Join(entity.plugin.Runtime.StateDirPath, "base")
+	basePath := filepath.Join(baseDir, entity.relPath)
+	provisionedDir := filepath.Join(entity.plugin.Runtime.StateDirPath, "provisioned")
 
 	var errs []error
 	appendError := func(err error) {
@@ -66,7 +67,8 @@ func (entity *FilesEntity) applyOrphan(stdout, stderr io.Writer) []error {
 		// if the package management left behind additional
 		// cleanup targets (most likely a backup of our custom
 		// configuration), we can delete these too
-		cleanupTargets := GetPackageManager(entity.plugin.Runtime.RootDirPath, stdout, stderr).AdditionalCleanupTargets(current.Path)
+		pm := GetPackageManager(entity.plugin.Runtime.RootDirPath, stderr)
+		cleanupTargets := pm.AdditionalCleanupTargets(current.Path)
 		for _, path := range cleanupTargets {
 			otherFile, err := fileutil.NewFileBuffer(path)
 			if err != nil {
@@ -74,30 +76,41 @@ func (entity *FilesEntity) applyOrphan(stdout, stderr io.Writer) []error {
 			}
 			if otherFile.EqualTo(provisioned) {
 				fmt.Fprintf(stdout, ">> also deleting %s\n", otherFile.Path)
-				appendError(os.Remove(otherFile.Path))
+				appendError(fileutil.Remove(otherFile.Path))
 			}
 		}
 
-		appendError(os.Remove(provisioned.Path))
-		appendError(os.Remove(basePath))
+		// updated target bases that were left behind are not
+		// needed anymore either
+		if finder, ok := pm.(StaleFileFinder); ok {
+			for _, path := range finder.StaleUpdatedTargetBases(current.Path) {
+				fmt.Fprintf(stdout, ">> also deleting %s\n", path)
+				appendError(fileutil.Remove(path))
+			}
+		}
+
+		appendError(fileutil.Remove(provisioned.Path))
+		appendError(fileutil.Remove(basePath))
 	case "restore":
 		// target is still there - restore the target base,
 		// *but* before that, check if there is an updated
 		// target base
-		updatedTBPath, reportedTBPath, err := GetPackageManager(entity.plugin.Runtime.RootDirPath, stdout, stderr).FindUpdatedTargetBase(current.Path)
+		updatedTBPath, reportedTBPath, err := GetPackageManager(entity.plugin.Runtime.RootDirPath, stderr).FindUpdatedTargetBase(current.Path)
 		appendError(err)
 		if updatedTBPath != "" {
 			fmt.Fprintf(stdout, ">> found updated target base: %s -> %s", reportedTBPath, current.Path)
 			//use this target base instead of the one in the BaseDirectory
-			appendError(os.Remove(basePath))
+			appendError(fileutil.Remove(basePath))
 			basePath = updatedTBPath
 		}
 
-		appendError(os.Remove(provisioned.Path))
+		appendError(fileutil.Remove(provisioned.Path))
 		appendError(fileutil.MoveFile(basePath, current.Path))
 	}
 
-	// TODO(majewsky): cleanup empty directories below
-	// StateDirPath+"/base" and StateDirPath+"/provisioned"
+	// cleanup empty directories below StateDirPath+"/base" and
+	// StateDirPath+"/provisioned"
+	appendError(fileutil.RemoveEmptyParents(filepath.Join(baseDir, entity.relPath), baseDir))
+	appendError(fileutil.RemoveEmptyParents(provisioned.Path, provisionedDir))
 	return errs
 }
@@ -0,0 +1,231 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
+	"github.com/holocm/holo/lib/holo"
+)
+
+// When `holo apply --force` overwrites manual changes to a target, the
+// target is first copied into "{{backupDir}}/{{timestamp}}/{{relPath}}",
+// from where it can be restored with `holo rollback`.  If a backup of
+// the same entity already exists for that timestamp, a counter is
+// appended to the timestamp ("{{timestamp}}-2" and so on).  Only the
+// most recent backups of each entity are kept.
+
+// maxBackupsPerEntity is the number of backups that are kept for each
+// entity.  Older backups are deleted when a new one is made.
+const maxBackupsPerEntity = 5
+
+// backupTimestampFormat is the format of the timestamps that identify
+// backups (ISO 8601 basic format, always in UTC).
+const backupTimestampFormat = "20060102T150405Z"
+
+// backupTimestamp returns the timestamp for a new backup.  For
+// reproducible test runs, the current time can be overridden with the
+// $HOLO_TEST_BACKUP_EPOCH environment variable.
+func backupTimestamp() string {
+	now := time.Now()
+	if epoch, err := strconv.ParseInt(os.Getenv("HOLO_TEST_BACKUP_EPOCH"), 10, 64); err == nil {
+		now = time.Unix(epoch, 0)
+	}
+	return now.UTC().Format(backupTimestampFormat)
+}
+
+// splitBackupTimestamp splits the counter that is appended to a backup
+// timestamp on collisions.  Backups without a counter have counter 1.
+func splitBackupTimestamp(timestamp string) (string, int) {
+	idx := strings.LastIndex(timestamp, "-")
+	if idx < 0 {
+		return timestamp, 1
+	}
+	counter, err := strconv.Atoi(timestamp[idx+1:])
+	if err != nil {
+		return timestamp, 1
+	}
+	return timestamp[:idx], counter
+}
+
+// backupTimestamps sorts backup timestamps chronologically.
+type backupTimestamps []string
+
+func (t backupTimestamps) Len() int      { return len(t) }
+func (t backupTimestamps) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t backupTimestamps) Less(i, j int) bool {
+	time1, counter1 := splitBackupTimestamp(t[i])
+	time2, counter2 := splitBackupTimestamp(t[j])
+	if time1 != time2 {
+		return time1 < time2
+	}
+	return counter1 < counter2
+}
+
+func (entity *FilesEntity) backupDir() string {
+	return filepath.Join(entity.plugin.Runtime.StateDirPath, "backup")
+}
+
+// backupPath returns the path of the backup of this entity with the
+// given timestamp.
+func (entity *FilesEntity) backupPath(timestamp string) string {
+	return filepath.Join(entity.backupDir(), timestamp, entity.relPath)
+}
+
+// Backups returns the timestamps of all backups of this entity, from
+// oldest to newest.
+func (entity *FilesEntity) Backups() ([]string, error) {
+	infos, err := ioutil.ReadDir(entity.backupDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []string
+	for _, info := range infos {
+		if info.IsDir() && fileutil.IsManageableFile(entity.backupPath(info.Name())) {
+			result = append(result, info.Name())
+		}
+	}
+	sort.Sort(backupTimestamps(result))
+	return result, nil
+}
+
+// newBackupPath returns the path for a new backup of this entity.  An
+// existing backup is never overwritten, since timestamps only have a
+// resolution of one second.
+func (entity *FilesEntity) newBackupPath() string {
+	timestamp := backupTimestamp()
+	path := entity.backupPath(timestamp)
+	for counter := 2; fileutil.IsManageableFile(path); counter++ {
+		path = entity.backupPath(fmt.Sprintf("%s-%d", timestamp, counter))
+	}
+	return path
+}
+
+// backupCurrent saves a copy of the current target, before it is
+// overwritten by a forced apply.
+func (entity *FilesEntity) backupCurrent(current fileutil.FileBuffer, stdout io.Writer) error {
+	path := entity.newBackupPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Cannot create directory %s: %s", filepath.Dir(path), err.Error())
+	}
+	err = current.Write(path)
+	if err != nil {
+		return fmt.Errorf("Cannot copy %s to %s: %s", current.Path, path, err.Error())
+	}
+	fmt.Fprintf(stdout, ">> saved manual changes to %s\n", path)
+
+	// enforce the retention limit
+	backups, err := entity.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > maxBackupsPerEntity {
+		err = fileutil.Remove(entity.backupPath(backups[0]))
+		if err != nil {
+			return err
+		}
+		err = fileutil.RemoveEmptyParents(entity.backupPath(backups[0]), entity.backupDir())
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Rollback restores the target from the backup with the given
+// timestamp, or from the most recent backup if the timestamp is empty.
+func (entity *FilesEntity) Rollback(timestamp string, stdout, stderr io.Writer) holo.ApplyResult {
+	result, err := entity.rollback(timestamp, stdout)
+	if err != nil {
+		fmt.Fprintf(stderr, "!! %s\n", err.Error())
+		return holo.ApplyError(1)
+	}
+	return result
+}
+
+func (entity *FilesEntity) rollback(timestamp string, stdout io.Writer) (holo.ApplyResult, error) {
+	backups, err := entity.Backups()
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups found for %s", entity.EntityID())
+	}
+
+	if timestamp == "" {
+		timestamp = backups[len(backups)-1]
+	} else {
+		found := false
+		for _, backup := range backups {
+			found = found || backup == timestamp
+		}
+		if !found {
+			return nil, fmt.Errorf("no backup of %s at %s (available: %s)",
+				entity.EntityID(), timestamp, strings.Join(backups, ", "))
+		}
+	}
+
+	backup, err := fileutil.NewFileBuffer(entity.backupPath(timestamp))
+	if err != nil {
+		return nil, err
+	}
+	current, err := entity.GetCurrent()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// (the provisioned target is left alone: the restored target
+	// counts as a manual change, so the next apply requires --force,
+	// which in turn takes a new backup of it)
+	if current.Manageable && current.EqualTo(backup) {
+		return holo.ApplyAlreadyApplied, nil
+	}
+	err = writeRestored(backup, current.Path)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(stdout, ">> restored from %s\n", backup.Path)
+	return holo.ApplyApplied, nil
+}
+
+// writeRestored writes the given backup to the given path, creating
+// parent directories if necessary.
+func writeRestored(backup fileutil.FileBuffer, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Cannot create directory %s: %s", filepath.Dir(path), err.Error())
+	}
+	return backup.Write(path)
+}
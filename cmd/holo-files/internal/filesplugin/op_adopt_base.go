@@ -0,0 +1,72 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// AdoptPackagedBase implements the "adopt-base" maintenance operation.
+// For each of the given entities, it replaces the target base with the
+// version of the target that was shipped by the system package (see
+// checkPristineBase), thus discarding local modifications that were
+// made before the target was first provisioned.  The target itself is
+// only updated by the next `holo apply`.
+func (p FilesPlugin) AdoptPackagedBase(entityIDs []string, stdout, stderr io.Writer) error {
+	entities, err := p.HoloScan(stderr)
+	if err != nil {
+		return err
+	}
+	entitiesByID := make(map[string]*FilesEntity, len(entities))
+	for _, entity := range entities {
+		entitiesByID[entity.EntityID()] = entity.(*FilesEntity)
+	}
+
+	for _, entityID := range entityIDs {
+		entity, exists := entitiesByID[entityID]
+		if !exists {
+			return fmt.Errorf("unknown entity ID \"%s\"", entityID)
+		}
+		base, err := entity.GetBase()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !base.Manageable {
+			return fmt.Errorf("%s has not been provisioned yet", entityID)
+		}
+
+		source, differs, err := entity.checkPristineBase(base, true, stderr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case source == "":
+			return fmt.Errorf("cannot find packaged version of %s", entityID)
+		case differs:
+			fmt.Fprintf(stdout, "%s: adopted packaged version from %s as target base\n", entityID, source)
+		default:
+			fmt.Fprintf(stdout, "%s: target base is identical to packaged version\n", entityID)
+		}
+	}
+	return nil
+}
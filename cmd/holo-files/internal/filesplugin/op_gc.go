@@ -0,0 +1,93 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
+)
+
+// CollectGarbage implements the "gc" maintenance operation.  It removes
+// files below the target base directory and the provisioned directory
+// whose entity no longer exists anywhere (i.e. there are no resources
+// for the entity, and the target has been deleted), as well as
+// leftover temporary files and empty directories in the state
+// directory.
+//
+// Orphaned entities whose target still exists are left alone, since
+// `holo apply` will restore their targets.
+func (p FilesPlugin) CollectGarbage(stdout, stderr io.Writer) error {
+	entities, err := p.HoloScan(stderr)
+	if err != nil {
+		return err
+	}
+	hasResources := make(map[string]bool)
+	for _, entity := range entities {
+		entity := entity.(*FilesEntity)
+		hasResources[entity.relPath] = len(entity.resources) > 0
+	}
+
+	for _, dirName := range []string{"base", "provisioned"} {
+		dir := filepath.Join(p.Runtime.StateDirPath, dirName)
+		var garbage []string
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			// skip over unaccessible stuff
+			if err != nil {
+				return err
+			}
+			// only look at manageable files (regular files or
+			// symlinks)
+			if !fileutil.IsManageableFileInfo(info) || path == dir {
+				return nil
+			}
+			relPath, _ := filepath.Rel(dir, path)
+			if fileutil.IsTempFile(path) {
+				garbage = append(garbage, path)
+			} else if !hasResources[relPath] && !fileutil.IsManageableFile(filepath.Join(p.Runtime.RootDirPath, relPath)) {
+				garbage = append(garbage, path)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		for _, path := range garbage {
+			err := fileutil.Remove(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, ">> removed %s\n", path)
+		}
+	}
+
+	for _, dirName := range []string{"base", "provisioned", "backup"} {
+		err := fileutil.RemoveEmptyDirs(filepath.Join(p.Runtime.StateDirPath, dirName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -21,7 +21,9 @@
 package filesplugin
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -35,10 +37,60 @@ import (
 // entities are guaranteed to have the concrete type "*FileEntity".
 // The entities are sorted by path.
 func (p FilesPlugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
-	// walk over the resource directory to find resources (and
-	// thus the corresponding entities)
+	err := checkPackageManager(p.Runtime.RootDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect resources (and thus the corresponding entities)
+	// from the manifests and the resource directory
 	entities := make(map[string]*FilesEntity)
 	resourceDir := p.Runtime.ResourceDirPath
+	facts := p.HostFacts()
+	conditions := make(map[string][]Condition) // key = disambiguator
+	addResource := func(resource Resource) {
+		// create new FilesEntity if necessary and store the
+		// resource in it
+		entityPath := resource.EntityPath()
+		if entities[entityPath] == nil {
+			entities[entityPath] = p.NewFilesEntity(entityPath)
+		}
+
+		// resources whose conditions are not met on this host
+		// are only shown to the user
+		// (if the conditions cannot be evaluated, applying the
+		// entity will fail)
+		disambiguator := resource.Disambiguator()
+		conds, ok := conditions[disambiguator]
+		if !ok {
+			var err error
+			conds, err = p.Conditions(disambiguator)
+			if err != nil {
+				conds = []Condition{{Err: err}}
+			}
+			conditions[disambiguator] = conds
+		}
+		if c := unmetCondition(conds, facts); c != nil {
+			entities[entityPath].addSkippedResource(resource, *c)
+		} else {
+			entities[entityPath].AddResource(resource)
+		}
+	}
+
+	// read the manifests first, since resource files that are
+	// listed in a manifest are not considered by the directory
+	// layout
+	manifestResources, err := p.manifestResources()
+	if err != nil {
+		return nil, err
+	}
+	isInManifest := make(map[string]bool)
+	for _, resource := range manifestResources {
+		isInManifest[resource.Path()] = true
+		addResource(resource)
+	}
+
+	// walk over the resource directory to find resources
 	filepath.Walk(resourceDir, func(resourcePath string, resourceFileInfo os.FileInfo, err error) error {
 		// skip over unaccessible stuff
 		if err != nil {
@@ -56,20 +108,18 @@ func (p FilesPlugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
 			return nil
 		}
 		// only look at files within subdirectories (files in
-		// the resource directory itself are skipped)
+		// the resource directory itself are skipped; these are
+		// resource directory configurations)
 		relPath, _ := filepath.Rel(resourceDir, resourcePath)
 		if !strings.ContainsRune(relPath, filepath.Separator) {
 			return nil
 		}
 
-		// create new FilesEntity if necessary and store the
-		// resource in it
-		resource := p.NewResource(resourcePath)
-		entityPath := resource.EntityPath
-		if entities[entityPath] == nil {
-			entities[entityPath] = p.NewFilesEntity(entityPath)
+		if isInManifest[resourcePath] {
+			return nil
 		}
-		entities[entityPath].AddResource(resource)
+
+		addResource(p.NewResource(resourcePath))
 		return nil
 	})
 
@@ -91,6 +141,11 @@ func (p FilesPlugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
 		if filePath == baseDir {
 			return nil
 		}
+		// temporary files from an interrupted write are not
+		// bases (they are cleaned up below)
+		if fileutil.IsTempFile(filePath) {
+			return nil
+		}
 
 		// ensure that there is an Entity for this base
 		// (it could be orphaned)
@@ -104,7 +159,10 @@ func (p FilesPlugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
 
 	// flatten result into list
 	result := make([]holo.Entity, 0, len(entities))
+	owners := &packageOwners{}
 	for _, entity := range entities {
+		entity.owners = owners
+		owners.relPaths = append(owners.relPaths, entity.relPath)
 		result = append(result, entity)
 	}
 
@@ -112,6 +170,53 @@ func (p FilesPlugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
 	return result, nil
 }
 
+// manifestResources returns the resources that are declared in the
+// resource directory configurations (see ResourceDirConfig.Resources).
+func (p FilesPlugin) manifestResources() ([]Resource, error) {
+	// only files directly in the resource directory can be
+	// resource directory configurations
+	fileinfos, err := ioutil.ReadDir(p.Runtime.ResourceDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result []Resource
+	for _, fileinfo := range fileinfos {
+		if fileinfo.IsDir() || filepath.Ext(fileinfo.Name()) != ".toml" {
+			continue
+		}
+		disambiguator := strings.TrimSuffix(fileinfo.Name(), ".toml")
+		manifestPath := filepath.Join(p.Runtime.ResourceDirPath, fileinfo.Name())
+		cfg, parsed, err := p.readResourceDirConfig(disambiguator)
+		if !parsed {
+			// we cannot tell which entities this manifest
+			// would declare resources for (and we must not
+			// scrub them as orphans), so this is fatal
+			return nil, err
+		}
+		// (the same goes for invalid resource declarations; if
+		// the configuration is invalid otherwise, the resources
+		// are still reported, but the entities will refuse to
+		// be applied since Conditions() fails)
+		for idx, entry := range cfg.Resources {
+			err := entry.validate()
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid resource #%d: %s", manifestPath, idx+1, err.Error())
+			}
+			resource := p.NewManifestResource(disambiguator, entry)
+			if !fileutil.IsManageableFile(resource.Path()) {
+				return nil, fmt.Errorf("%s: resource file %s for %s does not exist or is not a manageable file",
+					manifestPath, resource.Path(), entry.Target)
+			}
+			result = append(result, resource)
+		}
+	}
+	return result, nil
+}
+
 type entityList []holo.Entity
 
 func (f entityList) Len() int { return len(f) }
@@ -26,6 +26,7 @@
 //    target base directory - "{{Runtime.StateDirPath}}/base"
 //    provisioned directory - "{{Runtime.StateDirPath}}/provisioned"
 //    resource directory    - "{{Runtime.ResourceDirPath}}"
+//    backup directory      - "{{Runtime.StateDirPath}}/backup"
 //
 // The flow of information between these looks like (for brevity, this
 // graph uses Pacman/libALPM names; see below for how it changes with
@@ -109,6 +110,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 
 	"github.com/holocm/holo/lib/holo"
@@ -122,8 +124,10 @@ type FilesPlugin struct {
 // HoloInfo returns metadata about this plugin.
 func (p FilesPlugin) HoloInfo() map[string]string {
 	return map[string]string{
-		"MIN_API_VERSION": "3",
-		"MAX_API_VERSION": "3",
+		"MIN_API_VERSION":   "3",
+		"MAX_API_VERSION":   "3",
+		"SUPPORTS_ROLLBACK": "1",
+		"PACKAGE_MANAGER":   PackageManagerName(p.Runtime.RootDirPath, os.Stderr),
 	}
 }
 
@@ -136,6 +140,15 @@ func (p FilesPlugin) HoloApply(entityID string, force bool, stdout, stderr io.Wr
 	return e.(*FilesEntity).Apply(force, stdout, stderr)
 }
 
+// HoloRollback restores the given entity from a backup.
+func (p FilesPlugin) HoloRollback(entityID, timestamp string, stdout, stderr io.Writer) holo.ApplyResult {
+	e, err := p.getEntity(entityID, stderr)
+	if err != nil {
+		return holo.ApplyError(1)
+	}
+	return e.(*FilesEntity).Rollback(timestamp, stdout, stderr)
+}
+
 // HoloDiff returns reference files to compare the (expected state,
 // current state) of the given entity.
 func (p FilesPlugin) HoloDiff(entityID string, stderr io.Writer) (string, string) {
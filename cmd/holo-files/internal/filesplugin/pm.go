@@ -21,14 +21,18 @@
 package filesplugin
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+
+	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
 )
 
 // PackageManager provides integration points with a distribution's
@@ -59,44 +63,354 @@ type PackageManager interface {
 	AdditionalCleanupTargets(targetPath string) []string
 }
 
+// StaleFileFinder is an optional interface for a PackageManager.
+type StaleFileFinder interface {
+	// StaleUpdatedTargetBases is called as part of the orphan
+	// handling when the target has been deleted.  When an
+	// application package is removed before Holo has picked up an
+	// updated target base (see FindUpdatedTargetBase), the system
+	// package manager may leave the updated target base behind.
+	// This method must return the paths of such files.  Since
+	// they only contain stock configuration, Holo deletes them.
+	StaleUpdatedTargetBases(targetPath string) []string
+}
+
+// PackageOwnerFinder is an optional interface for a PackageManager.
+type PackageOwnerFinder interface {
+	// FindPackageOwners is called by `holo scan` to report which
+	// installed packages own the given targets (identified by
+	// their paths below the rootDir).  Since running the package
+	// manager once per target is slow, all targets are queried at
+	// once.  The result maps the path of each target that is owned
+	// by a package to the name and version of that package,
+	// separated by a space.  Targets that are not owned by any
+	// package are missing from the result (as are all targets if
+	// the package database cannot be queried).
+	FindPackageOwners(rootDir string, relPaths []string) map[string]string
+}
+
+// ModifiedFileFinder is an optional interface for a PackageManager.
+type ModifiedFileFinder interface {
+	// FindModifiedTargets is called by `holo scan` after
+	// FindPackageOwners, with its result, to report which of the
+	// owned targets the package manager considers modified (i.e.
+	// their contents differ from the version shipped in the
+	// package).  All targets are verified at once.  The result
+	// contains the paths (below the rootDir) of the modified
+	// targets.
+	FindModifiedTargets(rootDir string, owners map[string]string) map[string]bool
+}
+
+// PristineBaseFinder is an optional interface for a PackageManager.
+type PristineBaseFinder interface {
+	// FindPristineTargetBase is called as part of the resource
+	// application algorithm, before the target is first recorded
+	// as the target base (and when --force is given).  If the
+	// target (identified by its path below the rootDir) is owned
+	// by an installed package, and the package archive is still
+	// available (usually in the package manager's cache), this
+	// method must write the target's contents as shipped in the
+	// package into w, and return a description of where they were
+	// found (usually the path to the package archive).  If the
+	// packaged version is not available, an empty source must be
+	// returned.
+	FindPristineTargetBase(rootDir, relPath string, w io.Writer) (source string, err error)
+}
+
+// packageManagers contains the PackageManager implementations by name.
+// These names can be given in $HOLO_FILES_PACKAGE_MANAGER, and are
+// reported by `holo-files info`.
+var packageManagers = map[string]PackageManager{
+	"apk":     pmAlpine{},
+	"dpkg":    pmDPKG{},
+	"none":    pmNone{},
+	"pacman":  pmPacman{},
+	"portage": pmPortage{},
+	"rpm":     pmRPM{},
+	"xbps":    pmXBPS{},
+}
+
 var pm PackageManager
 
 // GetPackageManager returns the most suitable PackageManager
-// implementation for the current system.
-func GetPackageManager(rootDir string, stderr, stdout io.Writer) PackageManager {
+// implementation for the current system.  Problems with the selection
+// are reported on stderr.  (An invalid $HOLO_FILES_PACKAGE_MANAGER is
+// already rejected by HoloScan, see checkPackageManager.)
+func GetPackageManager(rootDir string, stderr io.Writer) PackageManager {
 	if pm == nil {
-		//which distribution are we running on?
-		isDist := getOsRelease(rootDir)
+		name, isDist, err := selectPackageManager(rootDir)
 		switch {
-		case isDist["alpine"]:
-			pm = pmAlpine{}
-		case isDist["arch"]:
-			pm = pmPacman{}
-		case isDist["debian"]:
-			pm = pmDPKG{}
-		case isDist["fedora"], isDist["suse"]:
-			pm = pmRPM{}
-		case isDist["unittest"]: // intentionally undocumented
-			pm = pmNone{}
-		default:
+		case err != nil:
+			fmt.Fprintf(stderr, "!! %s\n", err.Error())
+		case name == "":
 			dists := make([]string, 0, len(isDist))
 			for dist := range isDist {
 				dists = append(dists, dist)
 			}
 			sort.Strings(dists)
-			fmt.Fprintf(stdout, "!! Running on an unrecognized distribution. Distribution IDs: %s\n", strings.Join(dists, ","))
-			fmt.Fprintf(stdout, ">> Please report this error at <https://github.com/holocm/holo/issues/new>\n")
-			fmt.Fprintf(stdout, ">> and include the contents of your /etc/os-release file.\n")
-
-			pm = pmNone{}
+			fmt.Fprintf(stderr, "!! Running on an unrecognized distribution. Distribution IDs: %s\n", strings.Join(dists, ","))
+			fmt.Fprintf(stderr, ">> Please report this error at <https://github.com/holocm/holo/issues/new>\n")
+			fmt.Fprintf(stderr, ">> and include the contents of your /etc/os-release file.\n")
+			fmt.Fprintf(stderr, ">> To select a package manager explicitly, set $HOLO_FILES_PACKAGE_MANAGER.\n")
+		}
+		if name == "" {
+			name = "none"
 		}
+		pm = packageManagers[name]
 	}
 	return pm
 }
 
+// PackageManagerName returns the name of the PackageManager
+// implementation that GetPackageManager chooses (see packageManagers).
+// If $HOLO_FILES_PACKAGE_MANAGER is invalid, this is reported on stderr,
+// and "none" is returned.
+func PackageManagerName(rootDir string, stderr io.Writer) string {
+	name, _, err := selectPackageManager(rootDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "!! %s\n", err.Error())
+	}
+	if name == "" {
+		return "none"
+	}
+	return name
+}
+
+// checkPackageManager returns an error if $HOLO_FILES_PACKAGE_MANAGER
+// is set to an invalid value.  Since the user explicitly asked for a
+// specific package manager, we must not continue without it.
+func checkPackageManager(rootDir string) error {
+	_, _, err := selectPackageManager(rootDir)
+	return err
+}
+
+// selectPackageManager returns the name of the most suitable
+// PackageManager implementation for the current system, or "" if the
+// distribution is not recognized.  In the latter case, isDist contains
+// the distribution IDs that were found in os-release(5).
+//
+// The choice can be overridden by setting $HOLO_FILES_PACKAGE_MANAGER
+// to either the name of a PackageManager implementation, or the ID of a
+// distribution that we recognize.
+func selectPackageManager(rootDir string) (name string, isDist map[string]bool, err error) {
+	if value := os.Getenv("HOLO_FILES_PACKAGE_MANAGER"); value != "" {
+		if _, ok := packageManagers[value]; ok {
+			return value, nil, nil
+		}
+		name = packageManagerForDistribution(map[string]bool{value: true})
+		if name == "" {
+			err = fmt.Errorf("invalid value for $HOLO_FILES_PACKAGE_MANAGER: %q", value)
+		}
+		return name, nil, err
+	}
+
+	//which distribution are we running on?
+	isDist = getOsRelease(rootDir)
+	return packageManagerForDistribution(isDist), isDist, nil
+}
+
+// packageManagerForDistribution returns the name of the PackageManager
+// implementation for the given set of distribution IDs, or "" if none
+// of them is recognized.
+func packageManagerForDistribution(isDist map[string]bool) string {
+	switch {
+	case isDist["alpine"]:
+		return "apk"
+	case isDist["arch"]:
+		return "pacman"
+	case isDist["debian"]:
+		return "dpkg"
+	case isDist["fedora"], isDist["suse"]:
+		return "rpm"
+	case isDist["gentoo"]:
+		return "portage"
+	case isDist["void"]:
+		return "xbps"
+	case isDist["unittest"]: // intentionally undocumented
+		return "none"
+	default:
+		return ""
+	}
+}
+
+// findSiblings returns the manageable files in the same directory as
+// the targetPath whose names are accepted by the given function.
+func findSiblings(targetPath string, accept func(name string) bool) (result []os.FileInfo) {
+	fileinfos, err := ioutil.ReadDir(filepath.Dir(targetPath))
+	if err != nil {
+		return nil
+	}
+	for _, fileinfo := range fileinfos {
+		if accept(fileinfo.Name()) && fileutil.IsManageableFileInfo(fileinfo) {
+			result = append(result, fileinfo)
+		}
+	}
+	return result
+}
+
+// siblingPaths converts the result of findSiblings into paths.
+func siblingPaths(targetPath string, fileinfos []os.FileInfo) []string {
+	result := make([]string, len(fileinfos))
+	for idx, fileinfo := range fileinfos {
+		result[idx] = filepath.Join(filepath.Dir(targetPath), fileinfo.Name())
+	}
+	return result
+}
+
+// useNewestUpdate is used by FindUpdatedTargetBase implementations for
+// package managers that can place multiple updated target bases next to
+// the target (if the package is updated multiple times before Holo
+// picks them up).  The paths must be sorted from oldest to newest.
+// The newest one is returned, and the others are removed since they
+// have been superseded.
+func useNewestUpdate(paths []string) (string, error) {
+	if len(paths) == 0 {
+		return "", nil
+	}
+	for _, path := range paths[:len(paths)-1] {
+		err := fileutil.Remove(path)
+		if err != nil {
+			return "", err
+		}
+	}
+	return paths[len(paths)-1], nil
+}
+
+// queryPackageManager runs a query command of the system package
+// manager, and returns its standard output.  If the command is not
+// available, or reports failure (e.g. because the queried file is
+// not owned by any package), ok is false.
+func queryPackageManager(name string, args ...string) (stdout string, ok bool) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
+
+// queryPackageManagerBatch is like queryPackageManager, but returns the
+// standard output even if the command reports failure, since querying
+// multiple files at once usually fails when only some of them are not
+// owned by any package.
+func queryPackageManagerBatch(name string, args ...string) (stdout string) {
+	out, _ := exec.Command(name, args...).Output()
+	return string(out)
+}
+
+// ownerNames returns the names of the packages in the given result of
+// FindPackageOwners, without duplicates.
+func ownerNames(owners map[string]string) []string {
+	isSeen := make(map[string]bool)
+	var names []string
+	for _, owner := range owners {
+		name := strings.Fields(owner)[0]
+		if !isSeen[name] {
+			isSeen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// extractWith runs a command that extracts a single file from a
+// package archive to its standard output, and copies that output into
+// w.  If filter is not empty, the output of the extraction command is
+// piped through the filter command first.  The number of bytes written
+// is returned.
+func extractWith(w io.Writer, command []string, filter []string) (int64, error) {
+	counter := &countingWriter{Writer: w}
+
+	cmds := []*exec.Cmd{exec.Command(command[0], command[1:]...)}
+	if len(filter) > 0 {
+		cmds = append(cmds, exec.Command(filter[0], filter[1:]...))
+	}
+	stderrs := make([]bytes.Buffer, len(cmds))
+	for idx, cmd := range cmds {
+		cmd.Stderr = &stderrs[idx]
+	}
+	cmds[len(cmds)-1].Stdout = counter
+
+	//connect the extraction command to the filter
+	var pipe []*os.File
+	if len(cmds) > 1 {
+		pipeReader, pipeWriter, err := os.Pipe()
+		if err != nil {
+			return 0, err
+		}
+		cmds[0].Stdout = pipeWriter
+		cmds[1].Stdin = pipeReader
+		pipe = []*os.File{pipeReader, pipeWriter}
+	}
+	closePipe := func() {
+		//the pipe is only used by the child processes
+		for _, f := range pipe {
+			f.Close()
+		}
+	}
+
+	for idx, cmd := range cmds {
+		err := cmd.Start()
+		if err != nil {
+			for _, started := range cmds[:idx] {
+				started.Process.Kill()
+				started.Wait()
+			}
+			closePipe()
+			return 0, err
+		}
+	}
+	closePipe()
+
+	var result error
+	for idx, cmd := range cmds {
+		err := cmd.Wait()
+		if err != nil && result == nil {
+			msg := strings.TrimSpace(stderrs[idx].String())
+			if msg == "" {
+				msg = err.Error()
+			}
+			result = fmt.Errorf("%s failed: %s", strings.Join(cmd.Args, " "), msg)
+		}
+	}
+	return counter.Count, result
+}
+
+// countingWriter is an io.Writer that counts the bytes written through
+// it.
+type countingWriter struct {
+	Writer io.Writer
+	Count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.Count += int64(n)
+	return n, err
+}
+
 // getOsRelease returns a set of distribution IDs, drawing on the ID=
 // and ID_LIKE= fields of os-release(5).
 func getOsRelease(rootDir string) map[string]bool {
+	variables, err := readOsRelease(rootDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! Cannot read os-release(5): %v\n", err)
+		return nil
+	}
+
+	//the distribution IDs we're looking for are in ID= (single value) or ID_LIKE= (space-separated list)
+	result := map[string]bool{variables["ID"]: true}
+	if idLike, ok := variables["ID_LIKE"]; ok {
+		ids := strings.Split(idLike, " ")
+		for _, id := range ids {
+			result[id] = true
+		}
+	}
+	return result
+}
+
+// readOsRelease returns the variables defined in os-release(5).
+func readOsRelease(rootDir string) (map[string]string, error) {
 	//read /etc/os-release, fall back to /usr/lib/os-release if not available
 	bytes, err := ioutil.ReadFile(filepath.Join(rootDir, "etc/os-release"))
 	if err != nil {
@@ -105,8 +419,7 @@ func getOsRelease(rootDir string) map[string]bool {
 		}
 	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "!! Cannot read os-release(5): %v\n", err)
-		return nil
+		return nil, err
 	}
 
 	//parse os-release syntax (a harshly limited subset of shell script)
@@ -136,14 +449,5 @@ func getOsRelease(rootDir string) map[string]bool {
 		//store assignment
 		variables[key] = value
 	}
-
-	//the distribution IDs we're looking for are in ID= (single value) or ID_LIKE= (space-separated list)
-	result := map[string]bool{variables["ID"]: true}
-	if idLike, ok := variables["ID_LIKE"]; ok {
-		ids := strings.Split(idLike, " ")
-		for _, id := range ids {
-			result[id] = true
-		}
-	}
-	return result
+	return variables, nil
 }
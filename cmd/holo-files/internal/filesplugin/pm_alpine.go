@@ -35,5 +35,14 @@ func (p pmAlpine) FindUpdatedTargetBase(targetPath string) (actualPath, reported
 }
 
 func (p pmAlpine) AdditionalCleanupTargets(targetPath string) (ret []string) {
+	//not used by apk
+	return nil
+}
+
+func (p pmAlpine) StaleUpdatedTargetBases(targetPath string) []string {
+	apknewPath := targetPath + ".apk-new"
+	if fileutil.IsManageableFile(apknewPath) {
+		return []string{apknewPath}
+	}
 	return nil
 }
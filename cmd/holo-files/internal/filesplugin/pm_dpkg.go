@@ -21,6 +21,10 @@
 package filesplugin
 
 import (
+	"io"
+	"path/filepath"
+	"strings"
+
 	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
 )
 
@@ -57,3 +61,140 @@ func (p pmDPKG) AdditionalCleanupTargets(targetPath string) []string {
 	//not used by dpkg
 	return []string{}
 }
+
+func (p pmDPKG) FindPackageOwners(rootDir string, relPaths []string) map[string]string {
+	if len(relPaths) == 0 {
+		return nil
+	}
+	admindir := "--admindir=" + filepath.Join(rootDir, "var/lib/dpkg")
+
+	args := []string{admindir, "--search"}
+	for _, relPath := range relPaths {
+		args = append(args, "/"+relPath)
+	}
+	pkgs := make(map[string]string)
+	isQueried := make(map[string]bool)
+	var pkgNames []string
+	for _, line := range strings.Split(queryPackageManagerBatch("dpkg-query", args...), "\n") {
+		pkg, path := p.parseSearchResult(line)
+		if pkg == "" || pkgs[path] != "" {
+			continue
+		}
+		pkgs[path] = pkg
+		if !isQueried[pkg] {
+			isQueried[pkg] = true
+			pkgNames = append(pkgNames, pkg)
+		}
+	}
+	if len(pkgNames) == 0 {
+		return nil
+	}
+
+	//(pkg may be qualified with an architecture, like "libc6:amd64",
+	//which is what ${binary:Package} reports as well)
+	args = []string{admindir, "--show", "--showformat=${binary:Package}\t${Version}\n"}
+	versions := make(map[string]string)
+	for _, line := range strings.Split(queryPackageManagerBatch("dpkg-query", append(args, pkgNames...)...), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 {
+			versions[fields[0]] = fields[1]
+		}
+	}
+
+	result := make(map[string]string)
+	for path, pkg := range pkgs {
+		if version := versions[pkg]; version != "" {
+			result[strings.TrimPrefix(path, "/")] = strings.SplitN(pkg, ":", 2)[0] + " " + version
+		}
+	}
+	return result
+}
+
+func (p pmDPKG) FindModifiedTargets(rootDir string, owners map[string]string) map[string]bool {
+	names := ownerNames(owners)
+	if len(names) == 0 {
+		return nil
+	}
+	args := append([]string{"--root=" + rootDir, "--verify"}, names...)
+
+	result := make(map[string]bool)
+	for _, line := range strings.Split(queryPackageManagerBatch("dpkg", args...), "\n") {
+		//line looks like "??5??????   /usr/bin/foo" or "??5?????? c /etc/foo",
+		//where the third character reports a checksum mismatch
+		if len(line) < 13 || line[9] != ' ' || line[11] != ' ' || line[2] != '5' {
+			continue
+		}
+		relPath := strings.TrimPrefix(line[12:], "/")
+		if owners[relPath] != "" {
+			result[relPath] = true
+		}
+	}
+	return result
+}
+
+func (p pmDPKG) FindPristineTargetBase(rootDir, relPath string, w io.Writer) (source string, err error) {
+	name, version, arch := p.owner(rootDir, relPath)
+	if name == "" {
+		return "", nil
+	}
+
+	//find the package archive in APT's cache (where the epoch separator is escaped)
+	fileName := name + "_" + strings.Replace(version, ":", "%3a", -1) + "_" + arch + ".deb"
+	debPath := filepath.Join(rootDir, "var/cache/apt/archives", fileName)
+	if !fileutil.IsManageableFile(debPath) {
+		return "", nil
+	}
+
+	_, err = extractWith(w,
+		[]string{"dpkg-deb", "--fsys-tarfile", debPath},
+		[]string{"tar", "-xOf", "-", "./" + relPath},
+	)
+	if err != nil {
+		return "", err
+	}
+	return debPath, nil
+}
+
+// owner returns the name, version and architecture of the installed
+// package that owns the given target, or empty strings if there is
+// none.
+func (p pmDPKG) owner(rootDir, relPath string) (name, version, arch string) {
+	admindir := "--admindir=" + filepath.Join(rootDir, "var/lib/dpkg")
+
+	out, ok := queryPackageManager("dpkg-query", admindir, "--search", "/"+relPath)
+	if !ok {
+		return "", "", ""
+	}
+	var pkg string
+	for _, line := range strings.Split(out, "\n") {
+		pkg, _ = p.parseSearchResult(line)
+		if pkg != "" {
+			break
+		}
+	}
+	if pkg == "" {
+		return "", "", ""
+	}
+
+	//(pkg may be qualified with an architecture, like "libc6:amd64")
+	out, ok = queryPackageManager("dpkg-query", admindir, "--show", "--showformat=${Package}\t${Version}\t${Architecture}", pkg)
+	fields := strings.Split(strings.TrimSpace(out), "\t")
+	if !ok || len(fields) != 3 {
+		return "", "", ""
+	}
+	return fields[0], fields[1], fields[2]
+}
+
+// parseSearchResult parses a line from the output of `dpkg-query
+// --search`, and returns the first package that owns the path, or
+// empty strings if the line does not describe an owned path.
+func (p pmDPKG) parseSearchResult(line string) (pkg, path string) {
+	//skip lines like "diversion by foo from: /etc/bar"
+	if strings.HasPrefix(line, "diversion ") || !strings.Contains(line, ": ") {
+		return "", ""
+	}
+	//line format is "pkg1, pkg2: /path"
+	fields := strings.SplitN(line, ": ", 2)
+	pkg = strings.TrimSpace(strings.Split(fields[0], ",")[0])
+	return pkg, strings.TrimSpace(fields[1])
+}
@@ -21,6 +21,7 @@
 package filesplugin
 
 import (
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"strconv"
@@ -70,3 +71,101 @@ func (p pmPacman) AdditionalCleanupTargets(targetPath string) (ret []string) {
 
 	return
 }
+
+func (p pmPacman) FindPackageOwners(rootDir string, relPaths []string) map[string]string {
+	if len(relPaths) == 0 {
+		return nil
+	}
+	args := []string{"--root", rootDir, "--dbpath", filepath.Join(rootDir, "var/lib/pacman"), "--query", "--owns"}
+	relPathOf := make(map[string]string, len(relPaths))
+	for _, relPath := range relPaths {
+		path := filepath.Join(rootDir, relPath)
+		relPathOf[path] = relPath
+		args = append(args, path)
+	}
+
+	result := make(map[string]string)
+	for _, line := range strings.Split(queryPackageManagerBatch("pacman", args...), "\n") {
+		//line looks like "/etc/foo is owned by pkg 1.0-1"
+		fields := strings.SplitN(line, " is owned by ", 2)
+		if len(fields) != 2 || len(strings.Fields(fields[1])) != 2 {
+			continue
+		}
+		if relPath, exists := relPathOf[fields[0]]; exists {
+			result[relPath] = fields[1]
+		}
+	}
+	return result
+}
+
+func (p pmPacman) FindModifiedTargets(rootDir string, owners map[string]string) map[string]bool {
+	names := ownerNames(owners)
+	if len(names) == 0 {
+		return nil
+	}
+	args := []string{"--root", rootDir, "--dbpath", filepath.Join(rootDir, "var/lib/pacman"), "--query", "--check", "--check"}
+	args = append(args, names...)
+
+	result := make(map[string]bool)
+	for _, line := range strings.Split(queryPackageManagerBatch("pacman", args...), "\n") {
+		//line looks like "warning: pkg: /usr/bin/foo (SHA256 checksum mismatch)"
+		//or "backup file: pkg: /etc/foo (Size mismatch)"; only mismatches
+		//of the contents are relevant here
+		if !strings.HasSuffix(line, " checksum mismatch)") && !strings.HasSuffix(line, " (Size mismatch)") {
+			continue
+		}
+		fields := strings.SplitN(line, ": ", 3)
+		if len(fields) != 3 || !strings.Contains(fields[2], " (") {
+			continue
+		}
+		path := fields[2][:strings.LastIndex(fields[2], " (")]
+		relPath, err := filepath.Rel(rootDir, path)
+		if err == nil && owners[relPath] != "" {
+			result[relPath] = true
+		}
+	}
+	return result
+}
+
+func (p pmPacman) FindPristineTargetBase(rootDir, relPath string, w io.Writer) (source string, err error) {
+	name, version := p.owner(rootDir, relPath)
+	if name == "" {
+		return "", nil
+	}
+
+	//find the package archive in the cache (the file name also contains the
+	//architecture and the compression format, which we don't know)
+	pattern := filepath.Join(rootDir, "var/cache/pacman/pkg", name+"-"+version+"-*.pkg.tar*")
+	matches, _ := filepath.Glob(pattern)
+	var pkgPath string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".sig") && fileutil.IsManageableFile(match) {
+			pkgPath = match
+			break
+		}
+	}
+	if pkgPath == "" {
+		return "", nil
+	}
+
+	_, err = extractWith(w, []string{"bsdtar", "-xOf", pkgPath, relPath}, nil)
+	if err != nil {
+		return "", err
+	}
+	return pkgPath, nil
+}
+
+// owner returns the name and version of the installed package that owns
+// the given target, or empty strings if there is none.
+func (p pmPacman) owner(rootDir, relPath string) (name, version string) {
+	//output looks like "/etc/foo is owned by pkg 1.0-1"
+	out, ok := queryPackageManager("pacman",
+		"--root", rootDir, "--dbpath", filepath.Join(rootDir, "var/lib/pacman"),
+		"--query", "--owns", filepath.Join(rootDir, relPath),
+	)
+	fields := strings.Fields(out)
+	if !ok || len(fields) < 2 {
+		return "", ""
+	}
+	return fields[len(fields)-2], fields[len(fields)-1]
+}
@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// pmPortage provides the PackageManager for Portage-based distributions
+// (Gentoo and derivatives).
+type pmPortage struct{}
+
+func (p pmPortage) FindUpdatedTargetBase(targetPath string) (actualPath, reportedPath string, err error) {
+	//for files in CONFIG_PROTECT, portage places the updated target base
+	//at "${dir}/._cfg${number}_${name}"
+	path, err := useNewestUpdate(p.updatedTargetBases(targetPath))
+	return path, path, err
+}
+
+func (p pmPortage) AdditionalCleanupTargets(targetPath string) []string {
+	//not used by portage
+	return nil
+}
+
+func (p pmPortage) StaleUpdatedTargetBases(targetPath string) []string {
+	return p.updatedTargetBases(targetPath)
+}
+
+// updatedTargetBases returns all "._cfg${number}_${name}" files, oldest
+// (i.e. lowest number) first.
+func (p pmPortage) updatedTargetBases(targetPath string) []string {
+	rx := regexp.MustCompile(`^\._cfg[0-9]{4}_` + regexp.QuoteMeta(filepath.Base(targetPath)) + `$`)
+	fileinfos := findSiblings(targetPath, rx.MatchString)
+	//the numbers have a fixed width, so they sort correctly as strings
+	sort.Sort(fileInfosByName(fileinfos))
+	return siblingPaths(targetPath, fileinfos)
+}
+
+type fileInfosByName []os.FileInfo
+
+func (f fileInfosByName) Len() int           { return len(f) }
+func (f fileInfosByName) Less(i, j int) bool { return f[i].Name() < f[j].Name() }
+func (f fileInfosByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -21,6 +21,11 @@
 package filesplugin
 
 import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
 	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
 )
 
@@ -56,3 +61,123 @@ func (p pmRPM) AdditionalCleanupTargets(targetPath string) []string {
 	//not used by RPM
 	return []string{}
 }
+
+// rpmCacheDirs are the locations (relative to the root directory) where
+// the various RPM-based package managers keep downloaded packages.
+var rpmCacheDirs = []string{
+	"var/cache/dnf/*/packages",
+	"var/cache/libdnf5/*/packages",
+	"var/cache/yum/*/*/*/packages",
+	"var/cache/zypp/packages/*/*",
+}
+
+func (p pmRPM) FindPackageOwners(rootDir string, relPaths []string) map[string]string {
+	if len(relPaths) == 0 {
+		return nil
+	}
+	//the output of `rpm --query --file` does not say which of the queried
+	//files a package owns, so list all files of the owning packages
+	args := []string{"--root", rootDir, "--query", "--file", "--queryformat",
+		"[%{FILENAMES}\t%{NAME} %|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\n]"}
+	isQueried := make(map[string]bool, len(relPaths))
+	for _, relPath := range relPaths {
+		isQueried["/"+relPath] = true
+		args = append(args, "/"+relPath)
+	}
+
+	result := make(map[string]string)
+	for _, line := range strings.Split(queryPackageManagerBatch("rpm", args...), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || !isQueried[fields[0]] {
+			continue
+		}
+		//(if multiple packages own the target, use the first one)
+		relPath := strings.TrimPrefix(fields[0], "/")
+		if result[relPath] == "" {
+			result[relPath] = fields[1]
+		}
+	}
+	return result
+}
+
+func (p pmRPM) FindModifiedTargets(rootDir string, owners map[string]string) map[string]bool {
+	if len(owners) == 0 {
+		return nil
+	}
+	//verify the packages that own the targets by way of the targets, since
+	//the owners do not include the architecture of the packages
+	args := []string{"--root", rootDir, "--verify", "--file"}
+	for relPath := range owners {
+		args = append(args, "/"+relPath)
+	}
+	sort.Strings(args[4:])
+
+	result := make(map[string]bool)
+	for _, line := range strings.Split(queryPackageManagerBatch("rpm", args...), "\n") {
+		//line looks like "S.5....T.    /usr/bin/foo" or "S.5....T.  c /etc/foo",
+		//where "S" reports a size mismatch and "5" a digest mismatch
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields[0]) != 9 || (fields[0][0] != 'S' && fields[0][2] != '5') {
+			continue
+		}
+		relPath := strings.TrimPrefix(fields[len(fields)-1], "/")
+		if owners[relPath] != "" {
+			result[relPath] = true
+		}
+	}
+	return result
+}
+
+func (p pmRPM) FindPristineTargetBase(rootDir, relPath string, w io.Writer) (source string, err error) {
+	name, _, nvra := p.owner(rootDir, relPath)
+	if name == "" {
+		return "", nil
+	}
+
+	//find the package archive in the cache
+	var rpmPath string
+	for _, dir := range rpmCacheDirs {
+		matches, _ := filepath.Glob(filepath.Join(rootDir, dir, nvra+".rpm"))
+		if len(matches) > 0 && fileutil.IsManageableFile(matches[0]) {
+			rpmPath = matches[0]
+			break
+		}
+	}
+	if rpmPath == "" {
+		return "", nil
+	}
+
+	count, err := extractWith(w,
+		[]string{"rpm2cpio", rpmPath},
+		[]string{"cpio", "--extract", "--quiet", "--to-stdout", "./" + relPath},
+	)
+	if err != nil {
+		return "", err
+	}
+	//cpio does not complain when the file is not in the archive (this
+	//happens e.g. for %ghost files), so we cannot distinguish that case
+	//from an empty file, and have to ignore both
+	if count == 0 {
+		return "", nil
+	}
+	return rpmPath, nil
+}
+
+// owner returns the name and version (including the epoch, if any) of
+// the installed package that owns the given target, as well as the
+// NAME-VERSION-RELEASE.ARCH string that identifies the package
+// archive, or empty strings if there is no such package.
+func (p pmRPM) owner(rootDir, relPath string) (name, version, nvra string) {
+	out, ok := queryPackageManager("rpm",
+		"--root", rootDir,
+		"--query", "--file",
+		"--queryformat", "%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{NAME}-%{VERSION}-%{RELEASE}.%{ARCH}\n",
+		"/"+relPath,
+	)
+	//(if multiple packages own the target, use the first one)
+	fields := strings.Split(strings.SplitN(out, "\n", 2)[0], "\t")
+	if !ok || len(fields) != 3 {
+		return "", "", ""
+	}
+	return fields[0], fields[1], fields[2]
+}
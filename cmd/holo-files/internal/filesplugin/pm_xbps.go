@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// pmXBPS provides the PackageManager for XBPS-based distributions
+// (Void Linux and derivatives).
+type pmXBPS struct{}
+
+func (p pmXBPS) FindUpdatedTargetBase(targetPath string) (actualPath, reportedPath string, err error) {
+	//xbps places the updated target base at "${target}.new-${version}"
+	path, err := useNewestUpdate(p.updatedTargetBases(targetPath))
+	return path, path, err
+}
+
+func (p pmXBPS) AdditionalCleanupTargets(targetPath string) []string {
+	//not used by xbps
+	return nil
+}
+
+func (p pmXBPS) StaleUpdatedTargetBases(targetPath string) []string {
+	return p.updatedTargetBases(targetPath)
+}
+
+// updatedTargetBases returns all "${target}.new-${version}" files,
+// oldest first.
+func (p pmXBPS) updatedTargetBases(targetPath string) []string {
+	prefix := filepath.Base(targetPath) + ".new-"
+	fileinfos := findSiblings(targetPath, func(name string) bool {
+		return len(name) > len(prefix) && name[:len(prefix)] == prefix
+	})
+	//version numbers are hard to compare, so go by modification time instead
+	sort.Stable(fileInfosByModTime(fileinfos))
+	return siblingPaths(targetPath, fileinfos)
+}
+
+type fileInfosByModTime []os.FileInfo
+
+func (f fileInfosByModTime) Len() int           { return len(f) }
+func (f fileInfosByModTime) Less(i, j int) bool { return f[i].ModTime().Before(f[j].ModTime()) }
+func (f fileInfosByModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -36,9 +36,16 @@ type Resource interface {
 
 	// Disambiguator returns the disambiguator, i.e. the Path()
 	// element before the EntityPath() that disambiguates multiple
-	// resources for the same entity.
+	// resources for the same entity.  For resources from a
+	// manifest (see ManifestEntry), it is the name of the
+	// manifest without the ".toml" extension.
 	Disambiguator() string
 
+	// Priority returns the key by which the resources of an
+	// entity are ordered.  This is the Disambiguator() unless a
+	// manifest says otherwise.
+	Priority() string
+
 	// EntityPath returns the path to the corresponding entity.
 	EntityPath() string
 
@@ -59,32 +66,89 @@ type Resource interface {
 }
 
 type rawResource struct {
-	Path          string
-	EntityPath    string
-	Disambiguator string
+	path          string
+	entityPath    string
+	disambiguator string
+	priority      string
 
 	plugin FilesPlugin
 }
 
+// Path implements the Resource interface.
+func (resource rawResource) Path() string { return resource.path }
+
+// Disambiguator implements the Resource interface.
+func (resource rawResource) Disambiguator() string { return resource.disambiguator }
+
+// EntityPath implements the Resource interface.
+func (resource rawResource) EntityPath() string { return resource.entityPath }
+
+// Priority implements the Resource interface.
+func (resource rawResource) Priority() string {
+	if resource.priority == "" {
+		return resource.disambiguator
+	}
+	return resource.priority
+}
+
 // NewResource creates a Resource instance when its path in the file
 // system is known.
 func (p FilesPlugin) NewResource(path string) Resource {
-	relPath, _ := filepath.Rel(p.Runtime.ResourceDirPath, strings.TrimSuffix(path, ".holoscript"))
+	relPath, _ := filepath.Rel(p.Runtime.ResourceDirPath, path)
 	segments := strings.SplitN(relPath, string(filepath.Separator), 2)
-	ext := filepath.Ext(segments[1])
+	strategy := strategyForPath(segments[1])
+	raw := rawResource{
+		path:          path,
+		disambiguator: segments[0],
+		entityPath:    segments[1],
+		plugin:        p,
+	}
+	if strategy != "apply" {
+		raw.entityPath = strings.TrimSuffix(raw.entityPath, filepath.Ext(raw.entityPath))
+	}
+	return newResource(raw, strategy)
+}
+
+// NewManifestResource creates a Resource instance for an entry in the
+// manifest of the given disambiguator.
+func (p FilesPlugin) NewManifestResource(disambiguator string, entry ManifestEntry) Resource {
 	raw := rawResource{
-		Path:          path,
-		Disambiguator: segments[0],
-		EntityPath:    filepath.Join(p.Runtime.RootDirPath, strings.TrimSuffix(segments[1], ext)),
+		path:          filepath.Join(p.Runtime.ResourceDirPath, entry.Source),
+		disambiguator: disambiguator,
+		priority:      entry.Priority,
+		entityPath:    strings.TrimPrefix(filepath.Clean(entry.Target), "/"),
 		plugin:        p,
 	}
-	switch ext {
+	if filepath.IsAbs(entry.Source) {
+		raw.path = filepath.Join(p.Runtime.RootDirPath, entry.Source)
+	}
+	strategy := entry.Strategy
+	if strategy == "" {
+		strategy = strategyForPath(entry.Source)
+	}
+	return newResource(raw, strategy)
+}
+
+// strategyForPath returns the ApplicationStrategy() for a resource
+// file, based on its file extension.
+func strategyForPath(path string) string {
+	switch filepath.Ext(path) {
 	case ".holoscript":
-		return Holoscript{raw}
+		return "passthru"
 	case ".patch":
+		return "patch"
+	default:
+		return "apply"
+	}
+}
+
+func newResource(raw rawResource, strategy string) Resource {
+	switch strategy {
+	case "passthru":
+		return Holoscript{raw}
+	case "patch":
 		return Patchfile{raw}
 	default:
-		raw.entityPath += ext
 		return StaticResource{raw}
 	}
 }
@@ -93,6 +157,11 @@ func (p FilesPlugin) NewResource(path string) Resource {
 // methods to satisfy the sort.Interface interface.
 type Resources []Resource
 
-func (f Resources) Len() int           { return len(f) }
-func (f Resources) Less(i, j int) bool { return f[i].Disambiguator < f[j].Disambiguator }
-func (f Resources) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f Resources) Len() int { return len(f) }
+func (f Resources) Less(i, j int) bool {
+	if f[i].Priority() == f[j].Priority() {
+		return f[i].Path() < f[j].Path()
+	}
+	return f[i].Priority() < f[j].Priority()
+}
+func (f Resources) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
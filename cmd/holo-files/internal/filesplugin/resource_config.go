@@ -0,0 +1,158 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package filesplugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ResourceDirConfig contains the configuration for all resources with
+// the same disambiguator.  It is read from the optional file
+// $HOLO_RESOURCE_DIR/$disambiguator.toml.
+type ResourceDirConfig struct {
+	// Conditions restrict the resources to certain hosts (see
+	// Condition for the syntax).
+	Conditions []string         `toml:"conditions"`
+	Holoscript HoloscriptConfig `toml:"holoscript"`
+	// Resources declares additional resources with this
+	// disambiguator that are not located in the directory layout.
+	Resources []ManifestEntry `toml:"resource"`
+
+	conditions []Condition
+}
+
+// ManifestEntry declares a resource whose location does not follow the
+// directory layout "$HOLO_RESOURCE_DIR/$disambiguator/$target[.$ext]".
+type ManifestEntry struct {
+	// Source is the path to the resource file, either relative to
+	// $HOLO_RESOURCE_DIR, or absolute (within $HOLO_ROOT_DIR).
+	Source string `toml:"source"`
+	// Target is the absolute path to the target file.
+	Target string `toml:"target"`
+	// Strategy is the ApplicationStrategy() of the resource
+	// ("apply", "passthru" or "patch").  If empty, it is chosen by
+	// the file extension of the source, like in the directory
+	// layout.
+	Strategy string `toml:"strategy"`
+	// Priority orders the resources of an entity, like the
+	// disambiguator does (which is also the default).
+	Priority string `toml:"priority"`
+}
+
+// HoloscriptConfig configures how holoscripts are executed.
+type HoloscriptConfig struct {
+	// Sandbox enables execution in a restricted environment (see
+	// package sandbox).
+	Sandbox bool `toml:"sandbox"`
+	// Timeout is the maximum runtime of a holoscript, in the format
+	// accepted by time.ParseDuration (e.g. "30s").  No timeout is
+	// enforced if empty.
+	Timeout string `toml:"timeout"`
+
+	timeout time.Duration
+}
+
+// ResourceDirConfig returns the configuration for the resources with
+// the given disambiguator.
+func (p FilesPlugin) ResourceDirConfig(disambiguator string) (ResourceDirConfig, error) {
+	cfg, _, err := p.readResourceDirConfig(disambiguator)
+	return cfg, err
+}
+
+// readResourceDirConfig is like ResourceDirConfig, but also reports
+// whether the file could be parsed.  If it could, but the configuration
+// is invalid, the returned configuration contains the values that were
+// read from the file.
+func (p FilesPlugin) readResourceDirConfig(disambiguator string) (cfg ResourceDirConfig, parsed bool, err error) {
+	path := filepath.Join(p.Runtime.ResourceDirPath, disambiguator+".toml")
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, true, nil
+		}
+		return cfg, false, err
+	}
+
+	md, err := toml.Decode(string(blob), &cfg)
+	if err != nil {
+		return cfg, false, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	err = cfg.validate(path, md)
+	return cfg, true, err
+}
+
+func (cfg *ResourceDirConfig) validate(path string, md toml.MetaData) error {
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for idx, key := range undecoded {
+			keys[idx] = key.String()
+		}
+		return fmt.Errorf("%s: unknown keys: %s", path, strings.Join(keys, ", "))
+	}
+	for _, input := range cfg.Conditions {
+		c, err := ParseCondition(input)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		cfg.conditions = append(cfg.conditions, c)
+	}
+	for idx, entry := range cfg.Resources {
+		err := entry.validate()
+		if err != nil {
+			return fmt.Errorf("%s: invalid resource #%d: %s", path, idx+1, err.Error())
+		}
+	}
+	if cfg.Holoscript.Timeout != "" {
+		var err error
+		cfg.Holoscript.timeout, err = time.ParseDuration(cfg.Holoscript.Timeout)
+		if err == nil && cfg.Holoscript.timeout <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid holoscript.timeout %q: %s", path, cfg.Holoscript.Timeout, err.Error())
+		}
+	}
+	return nil
+}
+
+func (entry ManifestEntry) validate() error {
+	switch {
+	case entry.Source == "":
+		return fmt.Errorf("missing source")
+	case !filepath.IsAbs(entry.Target):
+		return fmt.Errorf("target %q is not an absolute path", entry.Target)
+	case filepath.Clean(entry.Target) == "/":
+		return fmt.Errorf("target %q is not a file", entry.Target)
+	}
+	switch entry.Strategy {
+	case "", "apply", "passthru", "patch":
+		return nil
+	default:
+		return fmt.Errorf("unknown strategy %q", entry.Strategy)
+	}
+}
@@ -23,17 +23,15 @@ package filesplugin
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 
 	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
+	"github.com/holocm/holo/cmd/holo-files/internal/patch"
 )
 
-// Patchfile is a Resource that is a `patch(1)` file that edits the
-// current version of the entity.
+// Patchfile is a Resource that is a unified diff (as produced by `diff
+// -u` or `git diff`) that edits the current version of the entity.
 type Patchfile struct{ rawResource }
 
 // ApplicationStrategy implements the Resource interface.
@@ -44,69 +42,67 @@ func (resource Patchfile) DiscardsPreviousBuffer() bool { return false }
 
 // ApplyTo implements the Resource interface.
 func (resource Patchfile) ApplyTo(entityBuffer fileutil.FileBuffer, stdout, stderr io.Writer) (fileutil.FileBuffer, error) {
-	// `patch` requires that the file it's operating on be a real
-	// file (not a pipe).  So, we'll write entityBuffer to a
-	// temporary file, run `patch`, then read it back.
-
-	// We really only normally need 1 temporary file, but:
-	//  1. since fileutil.FileBuffer.Write removes the file and then
-	//     re-creates it, that's a bit racy
-	//  2. The only way to limit patch to operating on a single
-	//     file is to name that file on the command line, but
-	//     doing that prevents it from unlinking the file, which
-	//     prevents type changes.
-	//
-	// Using a temporary directory lets us easily work around both
-	// of these issues.  Unfortunately, this allows the patch to
-	// create new files other than the one for the entity we are
-	// applying.  However, it can't escape the temporary
-	// directory, so we'll just "allow" that, and document that we
-	// ignore those files.
-	targetDir, err := ioutil.TempDir(os.Getenv("HOLO_CACHE_DIR"), "patch-target.")
+	file, err := os.Open(resource.Path())
 	if err != nil {
 		return fileutil.FileBuffer{}, err
 	}
-	defer os.RemoveAll(targetDir)
-	targetPath := filepath.Join(targetDir, filepath.Base(entityBuffer.Path))
-
-	// Write entityBuffer to the temporary file
-	err = entityBuffer.Write(targetPath)
+	files, err := patch.Parse(file)
+	file.Close()
 	if err != nil {
-		return fileutil.FileBuffer{}, err
+		return fileutil.FileBuffer{}, fmt.Errorf("cannot parse %s: %s", resource.Path(), err.Error())
 	}
 
-	// Run `patch` on the temporary file
-	patchfile, err := filepath.Abs(resource.Path())
-	if err != nil {
-		return fileutil.FileBuffer{}, err
+	//the patch is applied to an in-memory copy of the entity
+	target := patch.Target{Exists: true, Mode: entityBuffer.Mode}
+	if entityBuffer.Mode&os.ModeSymlink != 0 {
+		target.Contents = []byte(entityBuffer.LinkTarget)
+	} else {
+		target.Contents, err = entityBuffer.ReadAll()
+		if err != nil {
+			return fileutil.FileBuffer{}, err
+		}
 	}
-	cmd := exec.Command("patch",
-		"-N",
-		"-i", patchfile,
-	)
-	cmd.Dir = targetDir
-	cmd.Stdout = stderr
-	cmd.Stderr = stderr
-	err = cmd.Run()
-	if err != nil {
-		return fileutil.FileBuffer{}, fmt.Errorf("execution failed: %s: %s", strings.Join(cmd.Args, " "), err.Error())
+
+	//Only the parts of the patch that refer to a file with the same
+	//basename as the entity are applied, in order.  (Several parts
+	//are needed e.g. to change the file type, which git represents
+	//as a deletion followed by a creation.)  The patch cannot create
+	//or modify any other files.
+	basename := filepath.Base(entityBuffer.Path)
+	applied := false
+	for _, part := range files {
+		if !part.Matches(basename) {
+			fmt.Fprintf(stderr, ">> ignoring changes to %s (line %d)\n", part.Name(), part.Line)
+			continue
+		}
+		applied = true
+
+		var results []patch.HunkResult
+		target, results, err = part.Apply(target)
+		for _, result := range results {
+			if msg := result.String(); msg != "" {
+				fmt.Fprintf(stderr, "%s:%d: %s\n", resource.Path(), result.Hunk.Line, msg)
+			}
+		}
+		if err != nil {
+			return fileutil.FileBuffer{}, fmt.Errorf("applying %s failed: %s", resource.Path(), err.Error())
+		}
+	}
+	if !applied {
+		return fileutil.FileBuffer{}, fmt.Errorf("applying %s failed: patch does not contain changes for %s", resource.Path(), basename)
+	}
+	if !target.Exists {
+		return fileutil.FileBuffer{}, fmt.Errorf("applying %s failed: patch deletes %s", resource.Path(), basename)
 	}
 
-	// Read the result back
-	//
-	// Allow `patch` to override everything but the filepath:
-	//  - file type (changable with git-style "deleted file
-	//    mode"/"new file mode" lines, which are implemented by at
-	//    least GNU patch, if not in strict POSIX mode)
-	//  - file permissions (changable with git-style "new mode"
-	//    lines, which are implemented by at least GNU patch)
-	//  - UID/GID (I don't know of a patch syntax that does this,
-	//    but maybe it will exist in the future)
-	//  - contents (obviously)
-	targetBuffer, err := fileutil.NewFileBuffer(targetPath)
-	if err != nil {
-		return fileutil.FileBuffer{}, err
+	//The patch may change the file type and permissions (with
+	//git-style mode lines) and the contents.  Ownership and
+	//extended attributes are retained (where applicable).
+	if target.Mode&os.ModeSymlink != 0 {
+		entityBuffer.SetLinkTarget(string(target.Contents))
+	} else {
+		entityBuffer.SetContents(target.Contents)
+		entityBuffer.Mode = target.Mode
 	}
-	targetBuffer.Path = entityBuffer.Path
-	return targetBuffer, nil
+	return entityBuffer, nil
 }
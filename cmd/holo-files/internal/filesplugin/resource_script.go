@@ -22,14 +22,19 @@
 package filesplugin
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/holocm/holo/cmd/holo-files/internal/fileutil"
+	"github.com/holocm/holo/cmd/holo-files/internal/sandbox"
 )
 
 // Holoscript is a Resource that is a script that edits the current
@@ -44,27 +49,117 @@ func (resource Holoscript) DiscardsPreviousBuffer() bool { return false }
 
 // ApplyTo implements the Resource interface.
 func (resource Holoscript) ApplyTo(entityBuffer fileutil.FileBuffer, stdout, stderr io.Writer) (fileutil.FileBuffer, error) {
+	cfg, err := resource.plugin.ResourceDirConfig(resource.Disambiguator())
+	if err != nil {
+		return fileutil.FileBuffer{}, err
+	}
+
 	// application of a holoscript requires file contents
-	entityBuffer, err := entityBuffer.ResolveSymlink()
+	entityBuffer, err = entityBuffer.ResolveSymlink()
 	if err != nil {
 		return fileutil.FileBuffer{}, err
 	}
 
-	// run command, fetch result file into out (not into the
-	// entity directly, in order not to corrupt the file there if
-	// the script run fails)
-	var out bytes.Buffer
-	cmd := exec.Command(resource.Path)
-	cmd.Stdin = strings.NewReader(entityBuffer.Contents)
-	cmd.Stdout = &out
+	in, err := entityBuffer.Open()
+	if err != nil {
+		return fileutil.FileBuffer{}, err
+	}
+	defer in.Close()
+
+	// run command, fetch result file into a temporary file (not
+	// into the entity directly, in order not to corrupt the file
+	// there if the script run fails)
+	out, err := ioutil.TempFile(os.Getenv("HOLO_CACHE_DIR"), "holoscript-output.")
+	if err != nil {
+		return fileutil.FileBuffer{}, err
+	}
+	defer out.Close()
+
+	// the script can request a file mode by writing it into this
+	// file (which is passed as a file descriptor, since the file
+	// system might be read-only for the script)
+	modeFile, err := ioutil.TempFile(os.Getenv("HOLO_CACHE_DIR"), "holoscript-mode.")
+	if err != nil {
+		return fileutil.FileBuffer{}, err
+	}
+	defer os.Remove(modeFile.Name())
+	defer modeFile.Close()
+
+	var cmd *exec.Cmd
+	if cfg.Holoscript.Sandbox {
+		cmd = sandbox.Command(resource.Path())
+	} else {
+		cmd = exec.Command(resource.Path())
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, resource.environment()...)
+	cmd.Stdin = in
+	cmd.Stdout = out
 	cmd.Stderr = stderr
-	err = cmd.Run()
+	cmd.ExtraFiles = []*os.File{modeFile} //fd 3
+	err = runWithTimeout(cmd, cfg.Holoscript.timeout)
 	if err != nil {
-		return fileutil.FileBuffer{}, fmt.Errorf("execution of %s failed: %s", resource.Path, err.Error())
+		return fileutil.FileBuffer{}, fmt.Errorf("execution of %s failed: %s", resource.Path(), err.Error())
 	}
 
 	// result is the stdout of the script
-	entityBuffer.Mode &^= os.ModeType
-	entityBuffer.Contents = out.String()
+	entityBuffer.SetContentsFromFile(out.Name())
+
+	// apply the requested file mode, if any
+	modeBytes, err := ioutil.ReadFile(modeFile.Name())
+	if err != nil {
+		return fileutil.FileBuffer{}, err
+	}
+	if modeStr := strings.TrimSpace(string(modeBytes)); modeStr != "" {
+		mode, err := strconv.ParseUint(modeStr, 8, 32)
+		if err != nil || mode > 0777 {
+			return fileutil.FileBuffer{}, fmt.Errorf("execution of %s failed: invalid file mode requested: %q", resource.Path(), modeStr)
+		}
+		entityBuffer.Mode = (entityBuffer.Mode &^ os.ModePerm) | os.FileMode(mode)
+	}
 	return entityBuffer, nil
 }
+
+// environment returns the environment variables that describe the
+// entity and resource to the holoscript.
+func (resource Holoscript) environment() []string {
+	runtime := resource.plugin.Runtime
+	return []string{
+		"HOLO_ENTITY_ID=file:" + filepath.Join("/", resource.EntityPath()),
+		"HOLO_TARGET_PATH=" + filepath.Join(runtime.RootDirPath, resource.EntityPath()),
+		"HOLO_BASE_PATH=" + filepath.Join(runtime.StateDirPath, "base", resource.EntityPath()),
+		"HOLO_PROVISIONED_PATH=" + filepath.Join(runtime.StateDirPath, "provisioned", resource.EntityPath()),
+		"HOLO_RESOURCE_PATH=" + resource.Path(),
+		"HOLO_DISAMBIGUATOR=" + resource.Disambiguator(),
+		"HOLO_MODE_FILE=/dev/fd/3",
+	}
+}
+
+// runWithTimeout runs the command, and kills it if it does not finish
+// within the given timeout (unless the timeout is 0). The command runs in
+// its own process group, so that processes started by it are killed as
+// well.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout == 0 {
+		return cmd.Run()
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		// this can fail silently if the process group has just exited
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	if !timer.Stop() {
+		//timer has fired already
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
@@ -40,11 +40,11 @@ func (resource StaticResource) DiscardsPreviousBuffer() bool { return true }
 
 // ApplyTo implements the Resource interface.
 func (resource StaticResource) ApplyTo(entityBuffer fileutil.FileBuffer, stdout, stderr io.Writer) (fileutil.FileBuffer, error) {
-	resourceBuffer, err := fileutil.NewFileBuffer(resource.Path)
+	resourceBuffer, err := fileutil.NewFileBuffer(resource.Path())
 	if err != nil {
 		return fileutil.FileBuffer{}, err
 	}
-	entityBuffer.Contents = resourceBuffer.Contents
+	entityBuffer.CopyContentsFrom(resourceBuffer)
 	entityBuffer.Mode = (entityBuffer.Mode &^ os.ModeType) | (resourceBuffer.Mode & os.ModeType)
 
 	//since Linux disregards mode flags on symlinks and always reports 0777 perms,
@@ -22,7 +22,11 @@
 package fileutil
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -35,16 +39,43 @@ var (
 	ErrExist         = errors.New("target exists and is not a manageable file")
 )
 
-// FileBuffer represents a file, loaded into memory. It is used in
-// holo.Apply() as an intermediary product of application steps.
+// FileBuffer represents a file. It is used in holo.Apply() as an
+// intermediary product of application steps.
+//
+// The contents of a regular file are not held in memory; they are
+// streamed from their source when needed, and compared by their
+// SHA-256 digest.  This keeps large binary files (firmware blobs, CA
+// bundles, ...) cheap to handle.
 type FileBuffer struct {
-	Path     string
-	Mode     os.FileMode
-	UID      int
-	GID      int
-	Contents string
+	Path string
+	Mode os.FileMode
+	UID  int
+	GID  int
+
+	// LinkTarget is the target of the symlink, if this buffer
+	// represents a symlink.
+	LinkTarget string
+
+	// Xattrs contains the extended attributes of a regular file
+	// (including SELinux labels and POSIX ACLs), which are
+	// restored when the buffer is written.  They are not
+	// considered by EqualTo.
+	Xattrs map[string][]byte
 
 	Manageable bool
+
+	contents *contents
+}
+
+// contents describes the contents of a regular file.  It is shared
+// between copies of the same FileBuffer, and is never modified once
+// the digest has been computed.
+type contents struct {
+	// exactly one of these is set
+	path string // the contents are read from this file on demand
+	data []byte // the contents are held in memory
+
+	digest string // cached; computed on first use
 }
 
 // NewFileBuffer creates a FileBuffer object by reading the manageable
@@ -73,18 +104,17 @@ func newFileBuffer(path string, follow bool) (fb FileBuffer, err error) {
 	fb.GID = int(stat.Gid)
 
 	if fb.Mode&os.ModeSymlink != 0 {
-		fb.Contents, err = os.Readlink(path)
+		fb.LinkTarget, err = os.Readlink(path)
 		if err != nil {
 			return
 		}
 		fb.Manageable = true
 	} else if fb.Mode.IsRegular() {
-		var contents []byte
-		contents, err = ioutil.ReadFile(path)
+		fb.contents = &contents{path: path}
+		fb.Xattrs, err = readXattrs(path)
 		if err != nil {
 			return
 		}
-		fb.Contents = string(contents)
 		fb.Manageable = true
 	} else {
 		err = &os.PathError{
@@ -97,6 +127,114 @@ func newFileBuffer(path string, follow bool) (fb FileBuffer, err error) {
 	return
 }
 
+// SetContents replaces the contents of the buffer with the given
+// bytes.  The buffer is turned into a regular file if it was a
+// symlink before.
+func (fb *FileBuffer) SetContents(data []byte) {
+	fb.Mode &^= os.ModeType
+	fb.LinkTarget = ""
+	fb.contents = &contents{data: data}
+}
+
+// SetContentsFromFile replaces the contents of the buffer with the
+// contents of the regular file at the given path.  The file is not
+// read until the contents are needed, so it must not be removed or
+// modified while the buffer is in use.
+func (fb *FileBuffer) SetContentsFromFile(path string) {
+	fb.Mode &^= os.ModeType
+	fb.LinkTarget = ""
+	fb.contents = &contents{path: path}
+}
+
+// SetLinkTarget turns the buffer into a symlink pointing to the given
+// target.
+func (fb *FileBuffer) SetLinkTarget(target string) {
+	fb.Mode = os.ModeSymlink | 0777
+	fb.LinkTarget = target
+	fb.Xattrs = nil
+	fb.contents = nil
+}
+
+// CopyContentsFrom replaces the contents (or link target) of the
+// buffer with those of the other buffer.  The file type is not
+// changed; the caller must adjust the Mode if necessary.
+func (fb *FileBuffer) CopyContentsFrom(other FileBuffer) {
+	fb.LinkTarget = other.LinkTarget
+	fb.contents = other.contents
+}
+
+// Open returns a reader for the contents of the buffer.  For a
+// symlink, it reads the link target.
+func (fb FileBuffer) Open() (io.ReadCloser, error) {
+	switch {
+	case fb.Mode&os.ModeSymlink != 0:
+		return ioutil.NopCloser(bytes.NewReader([]byte(fb.LinkTarget))), nil
+	case fb.contents == nil:
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	case fb.contents.path != "":
+		return os.Open(fb.contents.path)
+	default:
+		return ioutil.NopCloser(bytes.NewReader(fb.contents.data)), nil
+	}
+}
+
+// ReadAll returns the complete contents of the buffer.  This should
+// only be used by application steps that require the contents in
+// memory anyway.
+func (fb FileBuffer) ReadAll() ([]byte, error) {
+	r, err := fb.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Detach loads the contents of the buffer into memory, so that the
+// buffer stays usable after the file it was read from is removed.
+func (fb FileBuffer) Detach() (FileBuffer, error) {
+	if fb.contents == nil || fb.contents.path == "" {
+		return fb, nil
+	}
+	data, err := fb.ReadAll()
+	if err != nil {
+		return FileBuffer{}, err
+	}
+	fb.contents = &contents{data: data, digest: fb.contents.digest}
+	return fb, nil
+}
+
+// Digest returns the hex-encoded SHA-256 digest of the contents of the
+// buffer (or of the link target, for symlinks).  The contents are
+// streamed, and the digest is cached for subsequent calls.
+func (fb FileBuffer) Digest() (string, error) {
+	if fb.Mode&os.ModeSymlink == 0 && fb.contents != nil && fb.contents.digest != "" {
+		return fb.contents.digest, nil
+	}
+
+	r, err := fb.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	if fb.Mode&os.ModeSymlink == 0 && fb.contents != nil {
+		fb.contents.digest = digest
+	}
+	return digest, nil
+}
+
+// Write writes the buffer to the given path.  The contents are first
+// copied into a temporary file next to the target, which is synced to
+// disk and then renamed to the target path (see Rename), so that the
+// target is never observed in a half-written state, not even after a
+// crash.
 func (fb FileBuffer) Write(path string) error {
 	//(check that we're not attempting to overwrite unmanageable files
 	info, err := os.Lstat(path)
@@ -114,24 +252,118 @@ func (fb FileBuffer) Write(path string) error {
 		}
 	}
 
-	//before writing to the target, remove what was there before
-	err = os.Remove(path)
-	if err != nil && !os.IsNotExist(err) {
+	tempPath, err := fb.writeTemp(path)
+	if err != nil {
 		return err
 	}
+	err = Rename(tempPath, path)
+	if err != nil {
+		_ = os.Remove(tempPath) // this can fail silently
+	}
+	return err
+}
 
-	//a manageable file is either a regular file...
-	if fb.Mode&os.ModeSymlink == 0 {
-		// regular file
-		err = ioutil.WriteFile(path, []byte(fb.Contents), fb.Mode)
-	} else {
-		// symlink
-		err = os.Symlink(fb.Contents, path)
+// writeTemp writes the buffer into a new temporary file in the same
+// directory as the given path, and returns the path to that temporary
+// file.
+func (fb FileBuffer) writeTemp(path string) (tempPath string, err error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
 	}
+
+	//a manageable file is either a symlink...
+	if fb.Mode&os.ModeSymlink != 0 {
+		tempPath, err = tempName(dir, name)
+		if err != nil {
+			return "", err
+		}
+		err = os.Symlink(fb.LinkTarget, tempPath)
+		if err != nil {
+			return "", err
+		}
+		err = os.Lchown(tempPath, fb.UID, fb.GID)
+		if err != nil {
+			_ = os.Remove(tempPath) // this can fail silently
+			return "", err
+		}
+		return tempPath, nil
+	}
+
+	//...or a regular file
+	tempPath, err = tempName(dir, name)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fb.Mode&^os.ModeType)
+	if err != nil {
+		return "", err
+	}
+	err = fb.copyContentsInto(file)
+	if err == nil {
+		err = file.Chown(fb.UID, fb.GID)
+	}
+	if err == nil && len(fb.Xattrs) > 0 {
+		err = fb.restoreXattrs(file)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempPath) // this can fail silently
+		return "", err
+	}
+	return tempPath, nil
+}
+
+// restoreXattrs restores fb.Xattrs on the given (newly written) file.
+// This must happen after chown(), since chown() clears the
+// security.capability attribute.
+func (fb FileBuffer) restoreXattrs(file *os.File) error {
+	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
-	return os.Lchown(path, fb.UID, fb.GID)
+	err = writeXattrs(file.Name(), fb.Xattrs)
+	if err != nil {
+		return err
+	}
+	//setting a POSIX ACL also sets the permission bits; but our Mode
+	//takes precedence (chmod() updates the ACL accordingly)
+	if _, ok := fb.Xattrs[XattrACLAccess]; ok {
+		return file.Chmod(info.Mode())
+	}
+	return nil
+}
+
+func (fb FileBuffer) copyContentsInto(w io.Writer) error {
+	r, err := fb.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// tempInfix is part of the name of the temporary files created by
+// Write, see StrayFiles.
+const tempInfix = ".holotmp."
+
+// tempName returns a path for a temporary file in the given directory
+// that does not exist yet.  (ioutil.TempFile always creates regular
+// files with mode 0600, which is not what we want.)
+func tempName(dir, name string) (string, error) {
+	file, err := ioutil.TempFile(dir, "."+name+tempInfix)
+	if err != nil {
+		return "", err
+	}
+	tempPath := file.Name()
+	file.Close()
+	return tempPath, os.Remove(tempPath)
 }
 
 //ResolveSymlink takes a FileBuffer that contains a symlink, resolves it and
@@ -148,7 +380,7 @@ func (fb FileBuffer) ResolveSymlink() (FileBuffer, error) {
 	}
 
 	//if the symlink target is relative, resolve it
-	target := fb.Contents
+	target := fb.LinkTarget
 	if !filepath.IsAbs(target) {
 		baseDir := filepath.Dir(fb.Path)
 		target = filepath.Join(baseDir, target)
@@ -157,8 +389,26 @@ func (fb FileBuffer) ResolveSymlink() (FileBuffer, error) {
 	return newFileBuffer(target, true)
 }
 
-//EqualTo returns whether two file buffers have the same content (or link target).
+//EqualTo returns whether two file buffers have the same metadata and
+//content (or link target). Contents are compared by their digest. If
+//either buffer cannot be read, they are considered to be different.
 func (fb FileBuffer) EqualTo(fa FileBuffer) bool {
-	fb.Path = fa.Path
-	return fa == fb
+	if fb.Mode != fa.Mode || fb.UID != fa.UID || fb.GID != fa.GID || fb.Manageable != fa.Manageable {
+		return false
+	}
+	if fb.Mode&os.ModeSymlink != 0 {
+		return fb.LinkTarget == fa.LinkTarget
+	}
+	if fb.contents == fa.contents {
+		return true
+	}
+	digestB, err := fb.Digest()
+	if err != nil {
+		return false
+	}
+	digestA, err := fa.Digest()
+	if err != nil {
+		return false
+	}
+	return digestA == digestB
 }
@@ -22,6 +22,10 @@ package fileutil
 
 import (
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 )
 
 // IsManageableFile returns whether the file can be managed by Holo
@@ -47,12 +51,6 @@ func CopyFile(fromPath, toPath string) error {
 	if err != nil {
 		return err
 	}
-	if buf.Mode&os.ModeSymlink != 0 && IsManageableFile(toPath) {
-		err = os.Remove(toPath)
-		if err != nil {
-			return err
-		}
-	}
 	return buf.Write(toPath)
 }
 
@@ -63,5 +61,161 @@ func MoveFile(fromPath, toPath string) error {
 	if err != nil {
 		return err
 	}
-	return os.Remove(fromPath)
+	return Remove(fromPath)
+}
+
+// Rename is like os.Rename, but it also syncs the affected directories
+// to disk, so that the rename is durable once Rename returns.
+func Rename(oldPath, newPath string) error {
+	err := os.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	oldDir, newDir := filepath.Dir(oldPath), filepath.Dir(newPath)
+	err = syncDir(newDir)
+	if err == nil && oldDir != newDir {
+		err = syncDir(oldDir)
+	}
+	return err
+}
+
+// Remove is like os.Remove, but it also syncs the parent directory to
+// disk, so that the removal is durable once Remove returns.
+func Remove(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// RemoveEmptyParents removes the parent directories of the given path
+// for as long as they are empty.  It stops at the given root directory,
+// which is never removed itself.
+func RemoveEmptyParents(path, root string) error {
+	root = filepath.Clean(root)
+	dir := filepath.Dir(filepath.Clean(path))
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		err := os.Remove(dir)
+		if err != nil {
+			if os.IsNotExist(err) || isDirNotEmpty(err) {
+				return nil
+			}
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// RemoveEmptyDirs removes all empty directories below the given root
+// directory (including directories that only contain empty
+// directories).  The root directory itself is never removed.
+func RemoveEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// remove subdirectories before their parents
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		err := os.Remove(dirs[idx])
+		if err != nil && !isDirNotEmpty(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isDirNotEmpty(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTEMPTY || pe.Err == syscall.EEXIST
+	}
+	return false
+}
+
+// syncDir syncs the directory entries of the given directory to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EINVAL {
+		//some filesystems do not support syncing directories
+		err = nil
+	}
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// StrayFiles returns the paths of leftover files that belong to the
+// file at the given path, and that were left behind by an interrupted
+// write operation: temporary files of Write, and the "$path.holonew"
+// file that holo-files writes before renaming it to $path.
+func StrayFiles(path string) ([]string, error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) || isNotDir(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result []string
+	for _, other := range names {
+		isStray := other == name+".holonew" ||
+			strings.HasPrefix(other, "."+name+tempInfix) ||
+			strings.HasPrefix(other, "."+name+".holonew"+tempInfix)
+		otherPath := filepath.Join(dir, other)
+		if isStray && IsManageableFile(otherPath) {
+			result = append(result, otherPath)
+		}
+	}
+	return result, nil
+}
+
+// IsTempFile returns whether the given path refers to a temporary file
+// created by Write.
+func IsTempFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempInfix)
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTDIR
+	}
+	return false
 }
@@ -0,0 +1,91 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package fileutil
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Extended attributes that are of special interest to us.  These are
+// just the most prominent ones; all extended attributes are
+// preserved.
+const (
+	XattrSELinux   = "security.selinux"
+	XattrACLAccess = "system.posix_acl_access"
+)
+
+// readXattrs returns all extended attributes of the regular file at
+// the given path.  If the filesystem does not support extended
+// attributes, no attributes (and no error) are returned.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if isXattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+
+	result := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := syscall.Getxattr(path, name, nil)
+		if err == syscall.ENODATA {
+			continue //removed since listing
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: err}
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(path, name, value)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: err}
+		}
+		result[name] = value[:valueSize]
+	}
+	return result, nil
+}
+
+// writeXattrs sets the given extended attributes on the regular file
+// at the given path.  Attributes that the filesystem does not support
+// are skipped silently.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		err := syscall.Setxattr(path, name, value, 0)
+		if err != nil && !isXattrUnsupported(err) {
+			return &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+func isXattrUnsupported(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP
+}
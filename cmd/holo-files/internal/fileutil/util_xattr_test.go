@@ -0,0 +1,87 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestXattrsArePreserved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holo-xattr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "src")
+	err = ioutil.WriteFile(srcPath, []byte("contents\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Setxattr(srcPath, "user.holo.test", []byte("value"), 0)
+	if isXattrUnsupported(err) {
+		t.Skip("user.* extended attributes are not supported in " + dir)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the extended attributes are read into the FileBuffer...
+	fb, err := NewFileBuffer(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fb.Xattrs["user.holo.test"]) != "value" {
+		t.Errorf("expected user.holo.test = %q in %s, got %q", "value", srcPath, fb.Xattrs["user.holo.test"])
+	}
+
+	//...and restored when writing it elsewhere, along with changes
+	fb.Xattrs["user.holo.other"] = []byte("other value")
+	dstPath := filepath.Join(dir, "dst")
+	err = fb.Write(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xattrs, err := readXattrs(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"user.holo.test": "value", "user.holo.other": "other value"}
+	for name, value := range expected {
+		if string(xattrs[name]) != value {
+			t.Errorf("expected %s = %q in %s, got %q", name, value, dstPath, xattrs[name])
+		}
+	}
+
+	//extended attributes do not count as modifications
+	other, err := NewFileBuffer(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Xattrs = nil
+	if !fb.EqualTo(other) {
+		t.Errorf("expected %s and %s to be equal regardless of extended attributes", srcPath, dstPath)
+	}
+}
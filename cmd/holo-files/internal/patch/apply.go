@@ -0,0 +1,280 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package patch
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MaxFuzz is the maximum number of context lines at the start and end
+// of a hunk that may be ignored when the hunk does not apply
+// otherwise.  (This is the same default as GNU patch uses.)
+const MaxFuzz = 2
+
+// Target is the state of a file that a patch is applied to.
+type Target struct {
+	// Exists is false if the file does not exist (anymore).
+	Exists bool
+	// Mode contains the file type (only regular files and
+	// symlinks are supported) and permissions.
+	Mode os.FileMode
+	// Contents contains the file contents, or the link target
+	// for symlinks.
+	Contents []byte
+}
+
+// HunkResult describes how a hunk was applied.
+type HunkResult struct {
+	Hunk *Hunk
+	// Failed is set if the hunk could not be applied.
+	Failed bool
+	// Line is the line (1-based) where the hunk was applied.
+	Line int
+	// Offset is the difference between Line and the line given in
+	// the hunk header.
+	Offset int
+	// Fuzz is the number of context lines that had to be ignored at
+	// the start and end of the hunk.
+	Fuzz int
+}
+
+// String returns a message describing the result in the style of GNU
+// patch, or an empty string if the hunk applied cleanly.
+func (r HunkResult) String() string {
+	if r.Failed {
+		return fmt.Sprintf("Hunk #%d FAILED at %d.", r.Hunk.Number, r.Hunk.OldStart)
+	}
+	var details []string
+	if r.Fuzz > 0 {
+		details = append(details, fmt.Sprintf(" with fuzz %d", r.Fuzz))
+	}
+	if r.Offset != 0 {
+		unit := "lines"
+		if r.Offset == 1 || r.Offset == -1 {
+			unit = "line"
+		}
+		details = append(details, fmt.Sprintf(" (offset %d %s)", r.Offset, unit))
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Hunk #%d succeeded at %d%s.", r.Hunk.Number, r.Line, strings.Join(details, ""))
+}
+
+// Apply applies this part of the patch to the given target.  The
+// results of all hunks are returned, even if some of them failed.  An
+// error is returned if any hunk failed, or if the file type or
+// existence of the target does not match the patch.
+func (f *File) Apply(t Target) (Target, []HunkResult, error) {
+	if f.IsNew {
+		if t.Exists {
+			return t, nil, fmt.Errorf("file to be created already exists")
+		}
+		t = Target{Exists: true, Mode: f.NewMode}
+		if t.Mode == 0 {
+			t.Mode = 0644
+		}
+	} else {
+		if !t.Exists {
+			return t, nil, fmt.Errorf("file to be patched does not exist")
+		}
+		if f.OldMode != 0 && f.OldMode&os.ModeType != t.Mode&os.ModeType {
+			return t, nil, fmt.Errorf("file to be patched has the wrong type")
+		}
+	}
+
+	lines, finalEOL := splitLines(t.Contents)
+	lines, finalEOL, results := f.applyHunks(lines, finalEOL)
+	for _, result := range results {
+		if result.Failed {
+			unit := "hunks"
+			if len(results) == 1 {
+				unit = "hunk"
+			}
+			return t, results, fmt.Errorf("%d out of %d %s FAILED", countFailed(results), len(results), unit)
+		}
+	}
+
+	if f.IsDeleted {
+		if len(lines) > 0 {
+			return t, results, fmt.Errorf("file to be deleted is not empty after patching")
+		}
+		return Target{Exists: false}, results, nil
+	}
+	if !f.IsNew && f.NewMode != 0 {
+		if f.NewMode&os.ModeType != t.Mode&os.ModeType {
+			return t, results, fmt.Errorf("cannot change file type without deleting the file first")
+		}
+		t.Mode = f.NewMode
+	}
+	t.Contents = joinLines(lines, finalEOL)
+	return t, results, nil
+}
+
+func (f *File) applyHunks(lines []string, finalEOL bool) ([]string, bool, []HunkResult) {
+	var (
+		out     []string
+		cursor  int // lines[:cursor] have been processed
+		offset  int // offset of the previous hunk
+		results []HunkResult
+	)
+
+	for _, hunk := range f.Hunks {
+		var oldLines, newLines []Line
+		for _, line := range hunk.Lines {
+			if line.Kind != '+' {
+				oldLines = append(oldLines, line)
+			}
+			if line.Kind != '-' {
+				newLines = append(newLines, line)
+			}
+		}
+
+		//where the hunk should start (0-based)
+		base := hunk.OldStart - 1
+		if hunk.OldLines == 0 {
+			base = hunk.OldStart //insert after this line
+		}
+
+		pos, trimStart, trimEnd, fuzz, ok := locate(lines, hunk.Lines, oldLines, base+offset, cursor)
+		if !ok {
+			results = append(results, HunkResult{Hunk: hunk, Failed: true})
+			continue
+		}
+		offset = pos - trimStart - base
+		results = append(results, HunkResult{
+			Hunk:   hunk,
+			Line:   pos - trimStart + 1,
+			Offset: offset,
+			Fuzz:   fuzz,
+		})
+
+		replacement := newLines[trimStart : len(newLines)-trimEnd]
+		end := pos + len(oldLines) - trimStart - trimEnd
+		out = append(out, lines[cursor:pos]...)
+		for _, line := range replacement {
+			out = append(out, line.Text)
+		}
+		cursor = end
+
+		//if the hunk extends to the end of the file, it decides
+		//whether the file ends with a newline
+		if end == len(lines) && trimEnd == 0 {
+			if len(replacement) > 0 {
+				finalEOL = !replacement[len(replacement)-1].NoEOL
+			} else {
+				finalEOL = true
+			}
+		}
+	}
+
+	out = append(out, lines[cursor:]...)
+	return out, finalEOL, results
+}
+
+// locate finds the position where the old lines of a hunk match, with
+// the smallest possible fuzz, and then as close as possible to the
+// expected position.  Matches must start at or after minPos.
+func locate(lines []string, hunkLines, oldLines []Line, expected, minPos int) (pos, trimStart, trimEnd, fuzz int, ok bool) {
+	//count context lines at both ends of the hunk (only these may
+	//be ignored when applying with fuzz)
+	leading := 0
+	for leading < len(hunkLines) && hunkLines[leading].Kind == ' ' {
+		leading++
+	}
+	trailing := 0
+	for trailing < len(hunkLines)-leading && hunkLines[len(hunkLines)-1-trailing].Kind == ' ' {
+		trailing++
+	}
+
+	for fuzz = 0; fuzz <= MaxFuzz; fuzz++ {
+		trimStart, trimEnd = min(fuzz, leading), min(fuzz, trailing)
+		if fuzz > 0 && trimStart+trimEnd == 0 {
+			break //fuzz does not change anything
+		}
+		pattern := oldLines[trimStart : len(oldLines)-trimEnd]
+		start := expected + trimStart
+
+		maxPos := len(lines) - len(pattern)
+		for distance := 0; ; distance++ {
+			before, after := start-distance, start+distance
+			if before < minPos && after > maxPos {
+				break
+			}
+			if after <= maxPos && after >= minPos && matchesAt(lines, pattern, after) {
+				return after, trimStart, trimEnd, fuzz, true
+			}
+			if distance > 0 && before >= minPos && before <= maxPos && matchesAt(lines, pattern, before) {
+				return before, trimStart, trimEnd, fuzz, true
+			}
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+func matchesAt(lines []string, pattern []Line, pos int) bool {
+	for idx, line := range pattern {
+		if lines[pos+idx] != line.Text {
+			return false
+		}
+	}
+	return true
+}
+
+func splitLines(contents []byte) (lines []string, finalEOL bool) {
+	if len(contents) == 0 {
+		return nil, true
+	}
+	finalEOL = bytes.HasSuffix(contents, []byte{'\n'})
+	text := strings.TrimSuffix(string(contents), "\n")
+	return strings.Split(text, "\n"), finalEOL
+}
+
+func joinLines(lines []string, finalEOL bool) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	text := strings.Join(lines, "\n")
+	if finalEOL {
+		text += "\n"
+	}
+	return []byte(text)
+}
+
+func countFailed(results []HunkResult) int {
+	count := 0
+	for _, result := range results {
+		if result.Failed {
+			count++
+		}
+	}
+	return count
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
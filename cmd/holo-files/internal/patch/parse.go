@@ -0,0 +1,307 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+// Package patch implements a parser and applier for unified diffs, as
+// produced by `diff -u` and `git diff`.  It is used by holo-files to
+// apply ".patch" resources without depending on an external `patch`
+// program.
+package patch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// File is the part of a patch that describes the changes to a single
+// file.
+type File struct {
+	// Names contains all file names given for this file in the
+	// patch (except for "/dev/null").  Usually, these are the same
+	// name with different prefixes ("a/", "b/").
+	Names []string
+	// Line is the line number in the patch where this part starts.
+	Line int
+
+	// These are set from git-style extended header lines.  A mode
+	// is 0 if it is not given.
+	IsNew, IsDeleted bool
+	OldMode, NewMode os.FileMode
+
+	Hunks []*Hunk
+}
+
+// Hunk is a single hunk (starting with an "@@" line) of a unified diff.
+type Hunk struct {
+	// Number is the 1-based index of the hunk within its File.
+	Number int
+	// Line is the line number in the patch of the "@@" line.
+	Line int
+
+	OldStart, OldLines int
+	NewStart, NewLines int
+
+	Lines []Line
+}
+
+// Line is a single line within a Hunk.
+type Line struct {
+	// Kind is ' ' for context lines, '-' for removed lines and
+	// '+' for added lines.
+	Kind byte
+	Text string
+	// NoEOL is set if this line is followed by a "\ No newline
+	// at end of file" marker.
+	NoEOL bool
+}
+
+// Name returns the first name of the file, for use in messages.
+func (f *File) Name() string {
+	if len(f.Names) == 0 {
+		return "(unnamed file)"
+	}
+	return f.Names[0]
+}
+
+// Matches returns whether the file has the given basename.
+func (f *File) Matches(basename string) bool {
+	for _, name := range f.Names {
+		if path.Base(name) == basename {
+			return true
+		}
+	}
+	return false
+}
+
+var hunkHeaderRx = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// Parse parses a patch in unified diff format, possibly with git-style
+// extended headers.  Text that is not part of a diff (e.g. a commit
+// message) is skipped.
+func Parse(r io.Reader) ([]*File, error) {
+	var (
+		files   []*File
+		current *File
+		hunk    *Hunk
+		lineNo  int
+		// remaining lines in the current hunk
+		oldLeft, newLeft int
+		// whether we are in a git header (between "diff --git"
+		// and the first hunk)
+		inGitHeader bool
+		// a "---" line that may start a unified diff header
+		pendingOld *string
+	)
+
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("line %d: %s", lineNo, fmt.Sprintf(format, args...))
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		//inside a hunk, the line counts tell us where it ends
+		if hunk != nil && (oldLeft > 0 || newLeft > 0 || strings.HasPrefix(line, `\`)) {
+			var kind byte = ' '
+			text := line
+			if line != "" {
+				kind, text = line[0], line[1:]
+			}
+			switch kind {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			case '\\':
+				if len(hunk.Lines) == 0 {
+					return nil, errorf("unexpected %q", line)
+				}
+				hunk.Lines[len(hunk.Lines)-1].NoEOL = true
+				continue
+			default:
+				return nil, errorf("malformed hunk line %q", line)
+			}
+			if oldLeft < 0 || newLeft < 0 {
+				return nil, errorf("hunk is longer than announced in its header")
+			}
+			hunk.Lines = append(hunk.Lines, Line{Kind: kind, Text: text})
+			continue
+		}
+		hunk = nil
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			current = &File{Line: lineNo, Names: parseGitNames(strings.TrimPrefix(line, "diff --git "))}
+			files = append(files, current)
+			inGitHeader = true
+			pendingOld = nil
+
+		case strings.HasPrefix(line, "--- "):
+			name := parseName(strings.TrimPrefix(line, "--- "))
+			pendingOld = &name
+
+		case strings.HasPrefix(line, "+++ ") && pendingOld != nil:
+			if !inGitHeader {
+				current = &File{Line: lineNo - 1}
+				files = append(files, current)
+			}
+			for _, name := range []string{*pendingOld, parseName(strings.TrimPrefix(line, "+++ "))} {
+				if name != "/dev/null" {
+					current.Names = appendUnique(current.Names, name)
+				}
+			}
+			pendingOld = nil
+
+		case strings.HasPrefix(line, "@@ ") && current != nil:
+			match := hunkHeaderRx.FindStringSubmatch(line)
+			if match == nil {
+				return nil, errorf("malformed hunk header %q", line)
+			}
+			hunk = &Hunk{
+				Number:   len(current.Hunks) + 1,
+				Line:     lineNo,
+				OldStart: atoi(match[1], 0),
+				OldLines: atoi(match[2], 1),
+				NewStart: atoi(match[3], 0),
+				NewLines: atoi(match[4], 1),
+			}
+			current.Hunks = append(current.Hunks, hunk)
+			oldLeft, newLeft = hunk.OldLines, hunk.NewLines
+			inGitHeader = false
+			pendingOld = nil
+
+		case inGitHeader:
+			err := current.parseGitHeaderLine(line)
+			if err != nil {
+				return nil, errorf("%s", err.Error())
+			}
+
+		default:
+			//garbage between diffs
+			pendingOld = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if hunk != nil && (oldLeft > 0 || newLeft > 0) {
+		return nil, errorf("unexpected end of patch within hunk")
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no diff found")
+	}
+	return files, nil
+}
+
+func (f *File) parseGitHeaderLine(line string) (err error) {
+	field := func(prefix string) (string, bool) {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix), true
+		}
+		return "", false
+	}
+
+	if value, ok := field("old mode "); ok {
+		f.OldMode, err = parseMode(value)
+	} else if value, ok := field("new mode "); ok {
+		f.NewMode, err = parseMode(value)
+	} else if value, ok := field("deleted file mode "); ok {
+		f.IsDeleted = true
+		f.OldMode, err = parseMode(value)
+	} else if value, ok := field("new file mode "); ok {
+		f.IsNew = true
+		f.NewMode, err = parseMode(value)
+	} else if value, ok := field("rename from "); ok {
+		f.Names = appendUnique(f.Names, value)
+	} else if value, ok := field("rename to "); ok {
+		f.Names = appendUnique(f.Names, value)
+	} else if strings.HasPrefix(line, "GIT binary patch") || strings.HasPrefix(line, "Binary files ") {
+		err = fmt.Errorf("binary patches are not supported")
+	}
+	//other lines ("index", "similarity index", etc.) are not relevant to us
+	return err
+}
+
+// parseGitNames parses the "a/foo b/foo" part of a "diff --git" line.
+func parseGitNames(value string) []string {
+	fields := strings.Fields(value)
+	if len(fields) == 2 {
+		return appendUnique([]string{fields[0]}, fields[1])
+	}
+	//if the names contain spaces, they are only unambiguous if
+	//they're identical (after the prefix)
+	if idx := strings.Index(value, " b/"); idx > 0 {
+		return appendUnique([]string{value[:idx]}, value[idx+1:])
+	}
+	return nil
+}
+
+// parseName parses the name on a "---" or "+++" line, which may be
+// followed by a timestamp.
+func parseName(value string) string {
+	if idx := strings.IndexByte(value, '\t'); idx >= 0 {
+		value = value[:idx]
+	}
+	return strings.TrimSpace(value)
+}
+
+// parseMode parses a git file mode like "100644" or "120000".
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q", value)
+	}
+	switch mode &^ 07777 {
+	case 0100000:
+		return os.FileMode(mode & 0777), nil
+	case 0120000:
+		return os.ModeSymlink | 0777, nil
+	default:
+		return 0, fmt.Errorf("unsupported file mode %q", value)
+	}
+}
+
+func atoi(value string, defaultValue int) int {
+	if value == "" {
+		return defaultValue
+	}
+	result, _ := strconv.Atoi(value) //cannot fail since the regex only matched digits
+	return result
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
@@ -0,0 +1,151 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package patch
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func checkApply(t *testing.T, name string, input Target, patchText string, expected Target, expectedMessages []string, expectedError string) {
+	files, err := Parse(strings.NewReader(patchText))
+	if err != nil {
+		t.Errorf("%s: Parse failed: %s", name, err.Error())
+		return
+	}
+
+	var (
+		actual   = input
+		messages []string
+	)
+	for _, file := range files {
+		var results []HunkResult
+		actual, results, err = file.Apply(actual)
+		for _, result := range results {
+			if msg := result.String(); msg != "" {
+				messages = append(messages, msg)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	//print for divergences in a readable format
+	var divergences []string
+	if err == nil {
+		if expectedError != "" {
+			divergences = append(divergences, "expected error '"+expectedError+"', but got nil")
+		}
+		if actual.Exists != expected.Exists || actual.Mode != expected.Mode || string(actual.Contents) != string(expected.Contents) {
+			divergences = append(divergences, "result = "+describe(actual)+", expected "+describe(expected))
+		}
+	} else {
+		if expectedError == "" {
+			divergences = append(divergences, "got error '"+err.Error()+"', but expected nil")
+		} else if !regexp.MustCompile(expectedError).MatchString(err.Error()) {
+			divergences = append(divergences, "err = '"+err.Error()+"', expected to match '"+expectedError+"'")
+		}
+	}
+	if strings.Join(messages, "\n") != strings.Join(expectedMessages, "\n") {
+		divergences = append(divergences, "messages = "+strings.Join(messages, " / ")+", expected "+strings.Join(expectedMessages, " / "))
+	}
+
+	if len(divergences) > 0 {
+		t.Errorf("%s failed", name)
+		for _, str := range divergences {
+			t.Log("- " + str)
+		}
+	}
+}
+
+func describe(t Target) string {
+	if !t.Exists {
+		return "(missing)"
+	}
+	return t.Mode.String() + " " + strings.Replace(string(t.Contents), "\n", `\n`, -1)
+}
+
+func file(contents string) Target {
+	return Target{Exists: true, Mode: 0644, Contents: []byte(contents)}
+}
+
+func TestApply(t *testing.T) {
+	checkApply(t, "clean",
+		file("a\nb\nc\nd\n"),
+		"--- a/foo\n+++ b/foo\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		file("a\nB\nc\nd\n"), nil, "",
+	)
+	checkApply(t, "offset",
+		file("x\nx\na\nb\nc\n"),
+		"--- a/foo\n+++ b/foo\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		file("x\nx\na\nB\nc\n"), []string{"Hunk #1 succeeded at 3 (offset 2 lines)."}, "",
+	)
+	checkApply(t, "fuzz",
+		file("z\nb\nc\nd\n"),
+		"--- a/foo\n+++ b/foo\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		file("z\nB\nc\nd\n"), []string{"Hunk #1 succeeded at 1 with fuzz 1."}, "",
+	)
+	checkApply(t, "multiple hunks",
+		file("1\n2\n3\n4\n5\n6\n7\n8\n9\n"),
+		"--- a/foo\n+++ b/foo\n@@ -1,2 +1,3 @@\n 1\n+1.5\n 2\n@@ -8,2 +9,1 @@\n 8\n-9\n",
+		file("1\n1.5\n2\n3\n4\n5\n6\n7\n8\n"), nil, "",
+	)
+	checkApply(t, "no newline at end of file",
+		file("a\nb\n"),
+		"--- a/foo\n+++ b/foo\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n\\ No newline at end of file\n",
+		file("a\nc"), nil, "",
+	)
+	checkApply(t, "failed hunk",
+		file("a\nb\nc\n"),
+		"--- a/foo\n+++ b/foo\n@@ -1,3 +1,3 @@\n a\n-x\n+y\n c\n",
+		Target{}, []string{"Hunk #1 FAILED at 1."}, `^1 out of 1 hunk FAILED$`,
+	)
+	checkApply(t, "mode change",
+		file("a\n"),
+		"diff --git a/foo b/foo\nold mode 100644\nnew mode 100755\n",
+		Target{Exists: true, Mode: 0755, Contents: []byte("a\n")}, nil, "",
+	)
+	checkApply(t, "type change",
+		file("a\n"),
+		"diff --git a/foo b/foo\ndeleted file mode 100644\n--- a/foo\n+++ /dev/null\n@@ -1 +0,0 @@\n-a\n"+
+			"diff --git a/foo b/foo\nnew file mode 120000\n--- /dev/null\n+++ b/foo\n@@ -0,0 +1 @@\n+bar\n\\ No newline at end of file\n",
+		Target{Exists: true, Mode: os.ModeSymlink | 0777, Contents: []byte("bar")}, nil, "",
+	)
+	checkApply(t, "create existing file",
+		file("a\n"),
+		"diff --git a/foo b/foo\nnew file mode 100644\n--- /dev/null\n+++ b/foo\n@@ -0,0 +1 @@\n+a\n",
+		Target{}, nil, `already exists`,
+	)
+}
+
+func TestParse(t *testing.T) {
+	_, err := Parse(strings.NewReader("--- a/foo\n+++ b/foo\n@@ -1,2 +1,2 @@\n a\n"))
+	if err == nil || err.Error() != "line 4: unexpected end of patch within hunk" {
+		t.Errorf("unexpected error for truncated hunk: %v", err)
+	}
+	_, err = Parse(strings.NewReader("just some text\n"))
+	if err == nil || err.Error() != "no diff found" {
+		t.Errorf("unexpected error for non-patch: %v", err)
+	}
+}
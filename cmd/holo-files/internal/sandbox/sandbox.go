@@ -0,0 +1,290 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+// Package sandbox runs programs in a restricted environment: with a
+// cleared environment, a read-only view of the file system (except for
+// a private /tmp and /var/tmp), no network access, and in a separate
+// PID namespace.  This is implemented with Linux namespaces.  When not
+// running as root, a user namespace is used in addition (which requires
+// unprivileged user namespaces to be enabled in the kernel).  Before the
+// program is executed, all capabilities are dropped and no_new_privs is
+// set, so that the program cannot undo the restrictions (e.g. by
+// remounting the file system read-write), not even when running as root.
+//
+// Since the file system setup must happen in the new namespaces, but
+// before the program is executed, the current executable is re-executed
+// as "holo-files holoscript-sandbox" to do that.  The entry point for
+// this helper is Main.
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// HelperArg is the first argument to holo-files that invokes Main.
+const HelperArg = "holoscript-sandbox"
+
+// DefaultPath is the value of $PATH within the sandbox.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Command returns a command that runs the given program in a sandbox.
+// The caller may set Stdin, Stdout, Stderr and Env on the result as
+// usual.  Env is initially set to a minimal environment.
+func Command(program string, args ...string) *exec.Cmd {
+	cmd := exec.Command("/proc/self/exe")
+	//the monobinary dispatches on argv[0]
+	cmd.Args = append([]string{"holo-files", HelperArg, program}, args...)
+	cmd.Env = []string{"PATH=" + DefaultPath}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if uid := os.Geteuid(); uid != 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+	}
+	return cmd
+}
+
+// Main is the entry point for the sandbox helper.  It expects to run as
+// PID 1 in the namespaces set up by Command.  The arguments are the
+// program to execute and its arguments.  On success, it does not
+// return.
+func Main(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "!! usage: holo-files %s <program> [<args>...]\n", HelperArg)
+		return 1
+	}
+	if os.Getpid() != 1 {
+		fmt.Fprintf(os.Stderr, "!! holo-files %s must not be called directly\n", HelperArg)
+		return 1
+	}
+
+	//capabilities and no_new_privs are per-thread, and are inherited
+	//across exec by the thread that calls it
+	runtime.LockOSThread()
+
+	err := setupFilesystem()
+	if err == nil {
+		err = dropPrivileges()
+	}
+	if err == nil {
+		err = syscall.Exec(args[0], args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "!! cannot set up sandbox: %s\n", err.Error())
+	return 1
+}
+
+func setupFilesystem() error {
+	//do not propagate any of the following changes to the outside
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return &os.PathError{Op: "make private", Path: "/", Err: err}
+	}
+
+	//make all mounts read-only
+	mountPoints, err := listMountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mountPoint := range mountPoints {
+		err := remountReadOnly(mountPoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	//provide a private /tmp and /var/tmp, and a /proc for the new PID
+	//namespace
+	for _, dir := range []string{"/tmp", "/var/tmp"} {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		if err != nil {
+			return &os.PathError{Op: "mount tmpfs", Path: dir, Err: err}
+		}
+	}
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return &os.PathError{Op: "mount proc", Path: "/proc", Err: err}
+	}
+	return nil
+}
+
+// remountReadOnly makes the given mount point read-only, while retaining
+// its other per-mount flags (which would be cleared otherwise, or cause
+// EPERM within a user namespace).
+func remountReadOnly(mountPoint string) error {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(mountPoint, &stat)
+	if err != nil {
+		if err == syscall.ENOENT || err == syscall.EACCES {
+			return nil //shadowed by another mount, or not accessible anyway
+		}
+		return &os.PathError{Op: "statfs", Path: mountPoint, Err: err}
+	}
+	if stat.Flags&stRDONLY != 0 {
+		return nil
+	}
+	//most ST_* flags have the same values as the MS_* flags
+	flags := uintptr(stat.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if stat.Flags&stRELATIME != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	err = syscall.Mount("", mountPoint, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|flags, "")
+	if err != nil {
+		return &os.PathError{Op: "remount read-only", Path: mountPoint, Err: err}
+	}
+	return nil
+}
+
+// dropPrivileges sets no_new_privs and drops all capabilities from the
+// bounding, ambient, inheritable, permitted and effective sets of the
+// calling thread.  Since the bounding set is empty afterwards, a program
+// running as root does not regain any capabilities when it is executed.
+func dropPrivileges() error {
+	err := prctl(prSetNoNewPrivs, 1, 0)
+	if err != nil {
+		return fmt.Errorf("cannot set no_new_privs: %s", err.Error())
+	}
+
+	lastCap, err := readLastCap()
+	if err != nil {
+		return err
+	}
+	for capability := uintptr(0); capability <= lastCap; capability++ {
+		err := prctl(prCapbsetDrop, capability, 0)
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("cannot drop capability %d from bounding set: %s", capability, err.Error())
+		}
+	}
+	err = prctl(prCapAmbient, prCapAmbientClearAll, 0)
+	if err != nil && err != syscall.EINVAL { //EINVAL: kernel without ambient capabilities
+		return fmt.Errorf("cannot clear ambient capabilities: %s", err.Error())
+	}
+
+	header := capHeader{Version: linuxCapabilityVersion3}
+	var data [2]capData //all sets empty
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot drop capabilities: %s", errno.Error())
+	}
+	return nil
+}
+
+// readLastCap returns the highest capability number known to the kernel.
+func readLastCap() (uintptr, error) {
+	contents, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse /proc/sys/kernel/cap_last_cap: %s", err.Error())
+	}
+	return uintptr(value), nil
+}
+
+func prctl(option, arg2, arg3 uintptr) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// constants and types from <linux/prctl.h> and <linux/capability.h> that
+// are not in package syscall
+const (
+	prCapbsetDrop           = 24
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+type capHeader struct {
+	Version uint32
+	Pid     int32
+}
+
+type capData struct {
+	Effective   uint32
+	Permitted   uint32
+	Inheritable uint32
+}
+
+// flags from statvfs(3) that are not in package syscall
+const (
+	stRDONLY   = 1
+	stRELATIME = 4096
+)
+
+// listMountPoints returns all mount points from /proc/self/mountinfo,
+// parents before children.
+func listMountPoints() ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		result = append(result, unescapeMountPoint(fields[4]))
+	}
+	return result, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes (like "\040" for a space)
+// in a mount point from /proc/self/mountinfo.
+func unescapeMountPoint(value string) string {
+	var result []byte
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] == '\\' && idx+4 <= len(value) {
+			if code, err := strconv.ParseUint(value[idx+1:idx+4], 8, 8); err == nil {
+				result = append(result, byte(code))
+				idx += 3
+				continue
+			}
+		}
+		result = append(result, value[idx])
+	}
+	return string(result)
+}
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -22,7 +23,13 @@
 package entrypoint
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+
 	"github.com/holocm/holo/cmd/holo-files/internal/filesplugin"
+	"github.com/holocm/holo/cmd/holo-files/internal/sandbox"
+	"github.com/holocm/holo/lib/holo"
 	"github.com/holocm/holo/lib/runplugin"
 )
 
@@ -30,5 +37,79 @@ import (
 // calling os.Exit().  This distinction is useful for monobinary and
 // testing purposes.
 func Main() (exitCode int) {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			return gcMain()
+		case "adopt-base":
+			return adoptBaseMain(os.Args[2:])
+		case sandbox.HelperArg:
+			return sandbox.Main(os.Args[2:])
+		}
+	}
 	return runplugin.Main(filesplugin.NewFilesPlugin)
 }
+
+// gcMain runs the "gc" maintenance operation.
+func gcMain() int {
+	return runMaintenance(func(plugin filesplugin.FilesPlugin) error {
+		return plugin.CollectGarbage(os.Stdout, os.Stderr)
+	})
+}
+
+// adoptBaseMain runs the "adopt-base" maintenance operation.
+func adoptBaseMain(entityIDs []string) int {
+	if len(entityIDs) == 0 {
+		fmt.Fprintln(os.Stderr, "!! usage: holo-files adopt-base <entity-id>...")
+		return 1
+	}
+	return runMaintenance(func(plugin filesplugin.FilesPlugin) error {
+		return plugin.AdoptPackagedBase(entityIDs, os.Stdout, os.Stderr)
+	})
+}
+
+// runMaintenance runs a maintenance operation.  Unlike the operations
+// from the holo-plugin-interface(7), these are invoked by the user
+// directly, so the plugin directories are derived from $HOLO_ROOT_DIR
+// unless they are given explicitly.
+func runMaintenance(operation func(filesplugin.FilesPlugin) error) int {
+	getenv := func(key, defaultValue string) string {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+		return defaultValue
+	}
+
+	rootDir := getenv("HOLO_ROOT_DIR", "/")
+	plugin := filesplugin.FilesPlugin{Runtime: holo.Runtime{
+		APIVersion:      3,
+		RootDirPath:     rootDir,
+		ResourceDirPath: getenv("HOLO_RESOURCE_DIR", filepath.Join(rootDir, "usr/share/holo/files")),
+		StateDirPath:    getenv("HOLO_STATE_DIR", filepath.Join(rootDir, "var/lib/holo/files")),
+		CacheDirPath:    os.Getenv("HOLO_CACHE_DIR"),
+	}}
+
+	// take the same lock as `holo apply`, so that the state directory
+	// is not modified concurrently
+	pidPath := filepath.Join(rootDir, "run/holo.pid")
+	pidFile, err := os.OpenFile(pidPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! Cannot create pid file %s: %s\n", pidPath, err.Error())
+		if os.IsExist(err) {
+			fmt.Fprintln(os.Stderr, "This usually means that Holo is currently running.")
+		}
+		return 1
+	}
+	fmt.Fprintf(pidFile, "%d\n", os.Getpid())
+	defer func() {
+		pidFile.Close()
+		os.Remove(pidPath)
+	}()
+
+	err = operation(plugin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
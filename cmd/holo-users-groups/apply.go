@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015-2016 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -31,8 +32,45 @@ import (
 
 //Apply implements the EntityDefinition interface.
 func (g *GroupDefinition) Apply(theProvisioned EntityDefinition) error {
-	//fix type on argument
-	provisioned := theProvisioned.(*GroupDefinition)
+	return backend.ApplyGroup(g, theProvisioned.(*GroupDefinition))
+}
+
+//Cleanup implements the EntityDefinition interface.
+func (g *GroupDefinition) Cleanup() error {
+	return backend.CleanupGroup(g)
+}
+
+//Apply implements the EntityDefinition interface.
+func (u *UserDefinition) Apply(theProvisioned EntityDefinition) error {
+	provisioned := theProvisioned.(*UserDefinition)
+	err := backend.ApplyUser(u, provisioned)
+	if err != nil {
+		return err
+	}
+	return u.provisionHome(provisioned)
+}
+
+//Cleanup implements the EntityDefinition interface.
+func (u *UserDefinition) Cleanup() error {
+	//remove the account first, so that no processes of the user can
+	//recreate files in the home directory while it is being removed
+	err := backend.CleanupUser(u)
+	if err != nil {
+		return err
+	}
+	return u.removeHome()
+}
+
+//shadowUtilsBackend is a Backend that calls the programs from shadow-utils
+//(useradd, usermod, etc.).
+type shadowUtilsBackend struct {
+	//if set, commands are only printed instead of executed (this is used
+	//during tests, where HOLO_ROOT_DIR is not "/")
+	mock bool
+}
+
+//ApplyGroup implements the Backend interface.
+func (b shadowUtilsBackend) ApplyGroup(g, provisioned *GroupDefinition) error {
 	isProvisioned := provisioned.IsProvisioned()
 
 	//assemble arguments
@@ -50,18 +88,75 @@ func (g *GroupDefinition) Apply(theProvisioned EntityDefinition) error {
 	if isProvisioned {
 		command = "groupmod"
 	}
-	return ExecProgramOrMock(command, args...)
+	err := b.execProgram(command, args...)
+	if err != nil {
+		return err
+	}
+
+	//update members
+	added, removed := diffNames(g.Members, provisioned.Members)
+	for _, name := range added {
+		err := b.execProgram("gpasswd", "--add", name, g.Name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range removed {
+		err := b.execProgram("gpasswd", "--delete", name, g.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	//update administrators (gpasswd can only replace the whole list, so the
+	//administrators that we don't manage need to be included)
+	added, removed = diffNames(g.Admins, provisioned.Admins)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	var admins []string
+	fields, err := Getent(etcGShadowPath, func(fields []string) bool { return fields[0] == g.Name })
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(fields) > 2 {
+		for _, name := range splitList(fields[2]) {
+			if !containsName(removed, name) {
+				admins = append(admins, name)
+			}
+		}
+	}
+	for _, name := range added {
+		if !containsName(admins, name) {
+			admins = append(admins, name)
+		}
+	}
+	return b.execProgram("gpasswd", "--administrators", strings.Join(admins, ","), g.Name)
 }
 
-//Cleanup implements the EntityDefinition interface.
-func (g *GroupDefinition) Cleanup() error {
-	return ExecProgramOrMock("groupdel", g.Name)
+//diffNames returns the names that need to be added to or removed from the
+//`current` list to obtain the `desired` list.
+func diffNames(desired, current []string) (added, removed []string) {
+	for _, name := range desired {
+		if !containsName(current, name) {
+			added = append(added, name)
+		}
+	}
+	for _, name := range current {
+		if !containsName(desired, name) {
+			removed = append(removed, name)
+		}
+	}
+	return
 }
 
-//Apply implements the EntityDefinition interface.
-func (u *UserDefinition) Apply(theProvisioned EntityDefinition) error {
-	//fix type on argument
-	provisioned := theProvisioned.(*UserDefinition)
+//CleanupGroup implements the Backend interface.
+func (b shadowUtilsBackend) CleanupGroup(g *GroupDefinition) error {
+	return b.execProgram("groupdel", g.Name)
+}
+
+//ApplyUser implements the Backend interface.
+func (b shadowUtilsBackend) ApplyUser(u, provisioned *UserDefinition) error {
 	isProvisioned := provisioned.IsProvisioned()
 
 	//assemble arguments
@@ -92,14 +187,73 @@ func (u *UserDefinition) Apply(theProvisioned EntityDefinition) error {
 	if u.Shell != "" && u.Shell != provisioned.Shell {
 		args = append(args, "--shell", u.Shell)
 	}
-	args = append(args, u.Name)
+	lockChanged := u.Locked != nil && (provisioned.Locked == nil || *u.Locked != *provisioned.Locked)
+	if u.Password != "" && (u.Password != provisioned.Password || lockChanged) {
+		//the password can be locked at the same time by prefixing it with "!"
+		password := u.Password
+		if u.Locked != nil && *u.Locked {
+			password = "!" + password
+		}
+		args = append(args, "--password", password)
+	} else if lockChanged && isProvisioned {
+		//(new accounts without a password are locked by useradd anyway)
+		if *u.Locked {
+			args = append(args, "--lock")
+		} else {
+			args = append(args, "--unlock")
+		}
+	}
+	if u.Expires != "" && u.Expires != provisioned.Expires {
+		expires := u.Expires
+		if expires == "never" {
+			expires = ""
+		}
+		args = append(args, "--expiredate", expires)
+	}
+	if u.Inactive != nil && (provisioned.Inactive == nil || *u.Inactive != *provisioned.Inactive) {
+		args = append(args, "--inactive", strconv.Itoa(*u.Inactive))
+	}
 
 	//call useradd/usermod
 	command := "useradd"
 	if isProvisioned {
 		command = "usermod"
 	}
-	return ExecProgramOrMock(command, args...)
+	if !isProvisioned || len(args) > 0 {
+		err := b.execProgram(command, append(args, u.Name)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	//the maximum password age can only be set with chage
+	if u.MaxAge != nil && (provisioned.MaxAge == nil || *u.MaxAge != *provisioned.MaxAge) {
+		err := b.execProgram("chage", "--maxdays", strconv.Itoa(*u.MaxAge), u.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	//subordinate IDs can only be given to usermod (not to useradd)
+	var subIDArgs []string
+	added, removed := diffNames(u.SubUIDs, provisioned.SubUIDs)
+	for _, value := range removed {
+		subIDArgs = append(subIDArgs, "--del-subuids", value)
+	}
+	for _, value := range added {
+		subIDArgs = append(subIDArgs, "--add-subuids", value)
+	}
+	added, removed = diffNames(u.SubGIDs, provisioned.SubGIDs)
+	for _, value := range removed {
+		subIDArgs = append(subIDArgs, "--del-subgids", value)
+	}
+	for _, value := range added {
+		subIDArgs = append(subIDArgs, "--add-subgids", value)
+	}
+	if len(subIDArgs) > 0 {
+		return b.execProgram("usermod", append(subIDArgs, u.Name)...)
+	}
+	return nil
 }
 
 func groupsToString(groups []string) string {
@@ -107,17 +261,25 @@ func groupsToString(groups []string) string {
 	return strings.Join(groups, ",")
 }
 
-//Cleanup implements the EntityDefinition interface.
-func (u *UserDefinition) Cleanup() error {
-	return ExecProgramOrMock("userdel", u.Name)
+//CleanupUser implements the Backend interface.
+func (b shadowUtilsBackend) CleanupUser(u *UserDefinition) error {
+	return b.execProgram("userdel", u.Name)
+}
+
+//RenameGroup implements the Backend interface.
+func (b shadowUtilsBackend) RenameGroup(oldName, newName string) error {
+	return b.execProgram("groupmod", "--new-name", newName, oldName)
+}
+
+//RenameUser implements the Backend interface.
+func (b shadowUtilsBackend) RenameUser(oldName, newName string) error {
+	return b.execProgram("usermod", "--login", newName, oldName)
 }
 
-//ExecProgramOrMock is a wrapper around exec.Command().Run() that, if run in a
-//test environment, only prints the command line instead of executing the
-//command.
-func ExecProgramOrMock(command string, arguments ...string) (err error) {
-	mock := os.Getenv("HOLO_ROOT_DIR") != "/"
-	if mock {
+//execProgram is a wrapper around exec.Command().Run() that, if run in a test
+//environment, only prints the command line instead of executing the command.
+func (b shadowUtilsBackend) execProgram(command string, arguments ...string) (err error) {
+	if b.mock {
 		fmt.Printf("MOCK: %s %s\n", command, shellEscapeArgs(arguments))
 		return nil
 	}
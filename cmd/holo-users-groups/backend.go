@@ -0,0 +1,68 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import "fmt"
+
+//Backend writes user and group definitions into the system databases.
+type Backend interface {
+	//ApplyGroup creates or modifies the group such that it conforms to the
+	//desired state. The provisioned argument is the current state of the
+	//group, as returned by GetProvisionedState().
+	ApplyGroup(desired, provisioned *GroupDefinition) error
+	//CleanupGroup deletes the group.
+	CleanupGroup(group *GroupDefinition) error
+	//ApplyUser creates or modifies the user account such that it conforms to
+	//the desired state. The provisioned argument is the current state of the
+	//user account, as returned by GetProvisionedState().
+	ApplyUser(desired, provisioned *UserDefinition) error
+	//CleanupUser deletes the user account.
+	CleanupUser(user *UserDefinition) error
+	//RenameGroup changes the name of a group (but not its GID or members).
+	RenameGroup(oldName, newName string) error
+	//RenameUser changes the name of a user account (but not its UID, home
+	//directory or group memberships).
+	RenameUser(oldName, newName string) error
+}
+
+//backend is the Backend selected by SelectBackend().
+var backend Backend
+
+//SelectBackend chooses the Backend according to the value of
+//$HOLO_USERS_GROUPS_BACKEND, which is either "native" or "shadow-utils". If
+//empty, shadow-utils is used for the root directory "/", and the native
+//backend for all other root directories (since shadow-utils can only
+//provision the running system).
+func SelectBackend(name, rootDir string) (Backend, error) {
+	switch name {
+	case "":
+		if rootDir == "/" {
+			return shadowUtilsBackend{}, nil
+		}
+		return nativeBackend{rootDir}, nil
+	case "native":
+		return nativeBackend{rootDir}, nil
+	case "shadow-utils":
+		return shadowUtilsBackend{mock: rootDir != "/"}, nil
+	default:
+		return nil, fmt.Errorf("invalid value for $HOLO_USERS_GROUPS_BACKEND: %q (valid values are \"native\" and \"shadow-utils\")", name)
+	}
+}
@@ -0,0 +1,580 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//nativeBackend is a Backend that edits the account databases in /etc
+//directly. Unlike shadow-utils, it can provision any root directory.
+type nativeBackend struct {
+	rootDir string
+}
+
+//accountDatabases holds the account databases while they are being edited.
+type accountDatabases struct {
+	passwd    *etcDatabase
+	group     *etcDatabase
+	shadow    *etcDatabase
+	gshadow   *etcDatabase
+	subuid    *etcDatabase
+	subgid    *etcDatabase
+	loginDefs keyValueFile
+	defaults  keyValueFile //from /etc/default/useradd
+}
+
+//edit locks and reads the account databases, calls the action, and writes
+//all databases that were changed by it. If the action fails, nothing is
+//written.
+func (b nativeBackend) edit(action func(db *accountDatabases) error) error {
+	unlock, err := lockAccountDatabases(b.rootDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	etcPath := func(name string) string {
+		return filepath.Join(b.rootDir, "etc", name)
+	}
+	var db accountDatabases
+	if db.passwd, err = readEtcDatabase(etcPath("passwd")); err != nil {
+		return err
+	}
+	if db.group, err = readEtcDatabase(etcPath("group")); err != nil {
+		return err
+	}
+	if db.shadow, err = readEtcDatabase(etcPath("shadow")); err != nil {
+		return err
+	}
+	if db.gshadow, err = readEtcDatabase(etcPath("gshadow")); err != nil {
+		return err
+	}
+	if db.subuid, err = readEtcDatabase(etcPath("subuid")); err != nil {
+		return err
+	}
+	if db.subgid, err = readEtcDatabase(etcPath("subgid")); err != nil {
+		return err
+	}
+	if db.loginDefs, err = readKeyValueFile(etcPath("login.defs")); err != nil {
+		return err
+	}
+	if db.defaults, err = readKeyValueFile(etcPath("default/useradd")); err != nil {
+		return err
+	}
+
+	err = action(&db)
+	if err != nil {
+		return err
+	}
+	for _, file := range []*etcDatabase{db.group, db.gshadow, db.passwd, db.shadow, db.subuid, db.subgid} {
+		err = file.write()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ApplyGroup implements the Backend interface.
+func (b nativeBackend) ApplyGroup(g, provisioned *GroupDefinition) error {
+	return b.edit(func(db *accountDatabases) error {
+		entry := db.group.find(g.Name, 4)
+
+		//create group
+		if entry == nil {
+			gid := g.GID
+			if gid == 0 {
+				min, max := db.loginDefs.idRange("GID", g.System)
+				var err error
+				gid, err = allocateID(usedIDs(db.group, 2), min, max, g.System)
+				if err != nil {
+					return fmt.Errorf("cannot allocate GID for group %s: %s", g.Name, err.Error())
+				}
+			} else if other := idOwner(db.group, 2, gid); other != "" {
+				return fmt.Errorf("GID %d is already used by group %s", gid, other)
+			}
+			db.addGroup(g.Name, gid)
+			return db.setGroupMembers(g, provisioned)
+		}
+
+		//modify group
+		newGID := strconv.Itoa(g.GID)
+		if g.GID > 0 && entry[2] != newGID {
+			if other := idOwner(db.group, 2, g.GID); other != "" {
+				return fmt.Errorf("GID %d is already used by group %s", g.GID, other)
+			}
+			//like groupmod(8), move the users that have this login group
+			oldGID := entry[2]
+			db.passwd.each(7, func(fields []string) []string {
+				if fields[3] != oldGID {
+					return nil
+				}
+				fields[3] = newGID
+				return fields
+			})
+			entry[2] = newGID
+			db.group.put(entry)
+		}
+		return db.setGroupMembers(g, provisioned)
+	})
+}
+
+//setGroupMembers adds the members and administrators declared by the group
+//definition, and removes those that were declared previously, but not
+//anymore. Other members and administrators are not touched.
+func (db *accountDatabases) setGroupMembers(g, provisioned *GroupDefinition) error {
+	addedMembers, removedMembers := diffNames(g.Members, provisioned.Members)
+	addedAdmins, removedAdmins := diffNames(g.Admins, provisioned.Admins)
+	for _, name := range append(addedMembers, addedAdmins...) {
+		if db.passwd.find(name, 7) == nil {
+			return fmt.Errorf("cannot add user %s to group %s: no such user", name, g.Name)
+		}
+	}
+
+	updateList := func(list string, added, removed []string) string {
+		for _, name := range removed {
+			list, _ = removeFromList(list, name)
+		}
+		for _, name := range added {
+			if !containsName(splitList(list), name) {
+				list = strings.Join(append(splitList(list), name), ",")
+			}
+		}
+		return list
+	}
+
+	if entry := db.group.find(g.Name, 4); entry != nil {
+		entry[3] = updateList(entry[3], addedMembers, removedMembers)
+		db.group.put(entry)
+	}
+	if entry := db.gshadow.find(g.Name, 4); entry != nil {
+		entry[2] = updateList(entry[2], addedAdmins, removedAdmins)
+		entry[3] = updateList(entry[3], addedMembers, removedMembers)
+		db.gshadow.put(entry)
+	}
+	return nil
+}
+
+//CleanupGroup implements the Backend interface.
+func (b nativeBackend) CleanupGroup(g *GroupDefinition) error {
+	return b.edit(func(db *accountDatabases) error {
+		entry := db.group.find(g.Name, 4)
+		if entry == nil {
+			return nil
+		}
+		user := db.passwd.findBy(7, func(fields []string) bool { return fields[3] == entry[2] })
+		if user != nil {
+			return fmt.Errorf("cannot delete group %s: it is the login group of user %s", g.Name, user[0])
+		}
+		db.group.remove(g.Name)
+		db.gshadow.remove(g.Name)
+		return nil
+	})
+}
+
+//ApplyUser implements the Backend interface.
+func (b nativeBackend) ApplyUser(u, provisioned *UserDefinition) error {
+	return b.edit(func(db *accountDatabases) error {
+		entry := db.passwd.find(u.Name, 7)
+		isNew := entry == nil
+		if isNew {
+			entry = []string{u.Name, "x", "", "", "", "", ""}
+		}
+
+		if u.UID != nil && entry[2] != strconv.Itoa(*u.UID) {
+			if other := idOwner(db.passwd, 2, *u.UID); other != "" {
+				return fmt.Errorf("UID %d is already used by user %s", *u.UID, other)
+			}
+			entry[2] = strconv.Itoa(*u.UID)
+		} else if isNew {
+			min, max := db.loginDefs.idRange("UID", u.System)
+			uid, err := allocateID(usedIDs(db.passwd, 2), min, max, u.System)
+			if err != nil {
+				return fmt.Errorf("cannot allocate UID for user %s: %s", u.Name, err.Error())
+			}
+			entry[2] = strconv.Itoa(uid)
+		}
+
+		if u.Group != "" {
+			group := db.group.find(u.Group, 4)
+			if group == nil {
+				return fmt.Errorf("group %s does not exist", u.Group)
+			}
+			entry[3] = group[2]
+		} else if isNew {
+			gid, err := db.defaultLoginGroup(u, entry[2])
+			if err != nil {
+				return err
+			}
+			entry[3] = gid
+		}
+
+		if u.Comment != "" {
+			entry[4] = u.Comment
+		}
+		if u.Home != "" {
+			entry[5] = u.Home
+		} else if isNew {
+			homeDir := db.defaults["HOME"]
+			if homeDir == "" {
+				homeDir = "/home"
+			}
+			entry[5] = path.Join(homeDir, u.Name)
+		}
+		if u.Shell != "" {
+			entry[6] = u.Shell
+		} else if isNew {
+			entry[6] = db.defaults["SHELL"]
+		}
+		db.passwd.put(entry)
+
+		if isNew && db.shadow.exists {
+			db.shadow.put(db.newShadowEntry(u))
+		}
+		err := db.applyShadowAttributes(u)
+		if err != nil {
+			return err
+		}
+		err = setSubIDRanges(db.subuid, u.Name, entry[2], u.SubUIDs, provisioned.SubUIDs)
+		if err != nil {
+			return err
+		}
+		err = setSubIDRanges(db.subgid, u.Name, entry[2], u.SubGIDs, provisioned.SubGIDs)
+		if err != nil {
+			return err
+		}
+
+		return db.setSupplementaryGroups(u.Name, u.Groups)
+	})
+}
+
+//CleanupUser implements the Backend interface.
+func (b nativeBackend) CleanupUser(u *UserDefinition) error {
+	return b.edit(func(db *accountDatabases) error {
+		entry := db.passwd.find(u.Name, 7)
+		if entry == nil {
+			return nil
+		}
+		db.passwd.remove(u.Name)
+		db.shadow.remove(u.Name)
+		isOwner := func(fields []string) bool { return fields[0] == u.Name || fields[0] == entry[2] }
+		db.subuid.removeWhere(3, isOwner)
+		db.subgid.removeWhere(3, isOwner)
+		err := db.setSupplementaryGroups(u.Name, nil)
+		if err != nil {
+			return err
+		}
+		db.gshadow.each(4, func(fields []string) []string {
+			admins, changed := removeFromList(fields[2], u.Name)
+			if !changed {
+				return nil
+			}
+			fields[2] = admins
+			return fields
+		})
+
+		//like userdel(8), delete the user's private group if no one else uses
+		//it (but not if it's managed by us as a separate entity)
+		if !db.loginDefs.getBool("USERGROUPS_ENAB", true) {
+			return nil
+		}
+		group := db.group.find(u.Name, 4)
+		if group == nil || group[2] != entry[3] || group[3] != "" {
+			return nil
+		}
+		if db.passwd.findBy(7, func(fields []string) bool { return fields[3] == group[2] }) != nil {
+			return nil
+		}
+		_, err = os.Stat(BaseImageDir.ImagePathFor(&GroupDefinition{Name: u.Name}))
+		if err == nil {
+			return nil
+		}
+		db.group.remove(u.Name)
+		db.gshadow.remove(u.Name)
+		return nil
+	})
+}
+
+//RenameGroup implements the Backend interface.
+func (b nativeBackend) RenameGroup(oldName, newName string) error {
+	return b.edit(func(db *accountDatabases) error {
+		if db.group.find(newName, 4) != nil {
+			return fmt.Errorf("cannot rename group %s to %s: group exists already", oldName, newName)
+		}
+		for _, file := range []*etcDatabase{db.group, db.gshadow} {
+			renameEntry(file, oldName, newName)
+		}
+		return nil
+	})
+}
+
+//RenameUser implements the Backend interface.
+func (b nativeBackend) RenameUser(oldName, newName string) error {
+	return b.edit(func(db *accountDatabases) error {
+		if db.passwd.find(newName, 7) != nil {
+			return fmt.Errorf("cannot rename user %s to %s: user exists already", oldName, newName)
+		}
+		for _, file := range []*etcDatabase{db.passwd, db.shadow, db.subuid, db.subgid} {
+			renameEntry(file, oldName, newName)
+		}
+
+		//like usermod(8), update the memberships in the group and gshadow
+		//databases (the administrators are in the third field of gshadow)
+		renameInLists := func(fields []string, indexes ...int) []string {
+			changed := false
+			for _, idx := range indexes {
+				names := splitList(fields[idx])
+				for i, name := range names {
+					if name == oldName {
+						names[i] = newName
+						changed = true
+					}
+				}
+				fields[idx] = strings.Join(names, ",")
+			}
+			if !changed {
+				return nil
+			}
+			return fields
+		}
+		db.group.each(4, func(fields []string) []string { return renameInLists(fields, 3) })
+		db.gshadow.each(4, func(fields []string) []string { return renameInLists(fields, 2, 3) })
+		return nil
+	})
+}
+
+//renameEntry changes the name (i.e. the first field) of all entries with the
+//old name.
+func renameEntry(db *etcDatabase, oldName, newName string) {
+	db.each(1, func(fields []string) []string {
+		if fields[0] != oldName {
+			return nil
+		}
+		fields[0] = newName
+		return fields
+	})
+}
+
+//addGroup adds a new group to the group and gshadow databases.
+func (db *accountDatabases) addGroup(name string, gid int) {
+	db.group.put([]string{name, "x", strconv.Itoa(gid), ""})
+	if db.gshadow.exists {
+		db.gshadow.put([]string{name, "!", "", ""})
+	}
+}
+
+//defaultLoginGroup chooses the login group for a new user that does not
+//specify one. Like useradd(8), when USERGROUPS_ENAB is set in login.defs, a
+//group with the same name as the user is created (and if possible, with the
+//same ID). If this group exists already, it is used instead.
+func (db *accountDatabases) defaultLoginGroup(u *UserDefinition, uid string) (string, error) {
+	if !db.loginDefs.getBool("USERGROUPS_ENAB", true) {
+		groupName := db.defaults["GROUP"]
+		if groupName == "" {
+			groupName = "100"
+		}
+		if _, err := strconv.Atoi(groupName); err == nil {
+			return groupName, nil
+		}
+		group := db.group.find(groupName, 4)
+		if group == nil {
+			return "", fmt.Errorf("default group %s does not exist", groupName)
+		}
+		return group[2], nil
+	}
+
+	if group := db.group.find(u.Name, 4); group != nil {
+		return group[2], nil
+	}
+	gid, err := strconv.Atoi(uid)
+	if err != nil || idOwner(db.group, 2, gid) != "" {
+		min, max := db.loginDefs.idRange("GID", u.System)
+		gid, err = allocateID(usedIDs(db.group, 2), min, max, u.System)
+		if err != nil {
+			return "", fmt.Errorf("cannot allocate GID for group %s: %s", u.Name, err.Error())
+		}
+	}
+	db.addGroup(u.Name, gid)
+	return strconv.Itoa(gid), nil
+}
+
+//newShadowEntry prepares the shadow entry for a new user. Like useradd(8),
+//the account is created without a valid password, and regular accounts use
+//the password aging defaults from login.defs.
+func (db *accountDatabases) newShadowEntry(u *UserDefinition) []string {
+	entry := []string{u.Name, "!", strconv.FormatInt(daysSinceEpoch(), 10), "", "", "", "", "", ""}
+	if !u.System {
+		entry[3] = db.loginDefs["PASS_MIN_DAYS"]
+		entry[4] = db.loginDefs["PASS_MAX_DAYS"]
+		entry[5] = db.loginDefs["PASS_WARN_AGE"]
+	}
+	return entry
+}
+
+//applyShadowAttributes writes the password attributes of the user into
+///etc/shadow.
+func (db *accountDatabases) applyShadowAttributes(u *UserDefinition) error {
+	if u.Password == "" && u.Locked == nil && u.Expires == "" && u.MaxAge == nil && u.Inactive == nil {
+		return nil
+	}
+	if !db.shadow.exists {
+		return fmt.Errorf("cannot set password attributes of user %s: %s does not exist", u.Name, db.shadow.path)
+	}
+	entry := db.shadow.find(u.Name, 9)
+	if entry == nil {
+		entry = db.newShadowEntry(u)
+	}
+
+	//like with `usermod --password`, a new password is not locked unless
+	//requested
+	password := entry[1]
+	if u.Password != "" {
+		password = u.Password
+	}
+	if u.Locked != nil {
+		password = strings.TrimPrefix(password, "!")
+		if *u.Locked {
+			password = "!" + password
+		} else if password == "" {
+			return fmt.Errorf("cannot unlock user %s: the account has no password", u.Name)
+		}
+	}
+	entry[1] = password
+
+	if u.Expires != "" {
+		days, err := dateToShadowDays(u.Expires)
+		if err != nil {
+			return err
+		}
+		entry[7] = days
+	}
+	if u.MaxAge != nil {
+		entry[4] = formatShadowDays(*u.MaxAge)
+	}
+	if u.Inactive != nil {
+		entry[6] = formatShadowDays(*u.Inactive)
+	}
+	db.shadow.put(entry)
+	return nil
+}
+
+//formatShadowDays is the inverse of parseShadowDays.
+func formatShadowDays(value int) string {
+	if value < 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+//setSupplementaryGroups makes the user a member of exactly the given groups
+//(in both the group and gshadow databases).
+func (db *accountDatabases) setSupplementaryGroups(userName string, groups []string) error {
+	wanted := make(map[string]bool)
+	for _, groupName := range groups {
+		if db.group.find(groupName, 4) == nil {
+			return fmt.Errorf("group %s does not exist", groupName)
+		}
+		wanted[groupName] = true
+	}
+
+	update := func(fields []string) []string {
+		members := splitList(fields[3])
+		isMember := false
+		for _, member := range members {
+			if member == userName {
+				isMember = true
+			}
+		}
+		switch {
+		case wanted[fields[0]] && !isMember:
+			fields[3] = strings.Join(append(members, userName), ",")
+		case !wanted[fields[0]] && isMember:
+			fields[3], _ = removeFromList(fields[3], userName)
+		default:
+			return nil
+		}
+		return fields
+	}
+	db.group.each(4, update)
+	db.gshadow.each(4, update)
+	return nil
+}
+
+//usedIDs returns the set of numeric IDs in the given field of the database.
+func usedIDs(db *etcDatabase, field int) map[int]bool {
+	result := make(map[int]bool)
+	db.each(field+1, func(fields []string) []string {
+		if id, err := strconv.Atoi(fields[field]); err == nil {
+			result[id] = true
+		}
+		return nil
+	})
+	return result
+}
+
+//idOwner returns the name of the entry that has the given numeric ID in the
+//given field, or "" if there is none.
+func idOwner(db *etcDatabase, field int, id int) string {
+	idStr := strconv.Itoa(id)
+	entry := db.findBy(field+1, func(fields []string) bool { return fields[field] == idStr })
+	if entry == nil {
+		return ""
+	}
+	return entry[0]
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+//removeFromList removes the value from a comma-separated list.
+func removeFromList(list, value string) (result string, changed bool) {
+	var kept []string
+	for _, item := range splitList(list) {
+		if item == value {
+			changed = true
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	return strings.Join(kept, ","), changed
+}
+
+//daysSinceEpoch returns the current date in the format of the "last password
+//change" field of /etc/shadow. For reproducible results, the timestamp is
+//taken from $SOURCE_DATE_EPOCH if set.
+func daysSinceEpoch() int64 {
+	now := time.Now().Unix()
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		now = epoch
+	}
+	return now / 86400
+}
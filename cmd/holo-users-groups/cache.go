@@ -0,0 +1,216 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+//The `scan` command stores its result in $HOLO_CACHE_DIR/entities.toml, so
+//that the `apply` and `diff` commands do not need to parse all definition
+//files again. The cache file is a TOML document like this:
+//
+//    version = 1
+//
+//    [[file]]
+//    path = "/usr/share/holo/users-groups/01-foo.toml"
+//    sha256 = "<hex digest of the file contents>"
+//
+//    [[entity]]
+//    definitionFiles = ["/usr/share/holo/users-groups/01-foo.toml"]
+//    [entity.user]
+//    name = "foo"
+//    ...
+//
+//There is one [[file]] table for each definition file that was read, and one
+//[[entity]] table for each entity, which contains the merged definition of the
+//entity in exactly one [entity.group] or [entity.user] table. (Orphaned
+//entities have an empty list of definitionFiles.) The attributes of the
+//definition are the same as in the definition files.
+//
+//When the cache is missing, was written in a different format version, or
+//does not match the current definition files, the definition files are
+//scanned again.
+
+//scanCacheVersion must be incremented whenever the format of the scan cache
+//changes incompatibly.
+const scanCacheVersion = 1
+
+type scanCache struct {
+	Version  int            `toml:"version"`
+	Files    []cachedFile   `toml:"file"`
+	Entities []cachedEntity `toml:"entity"`
+}
+
+type cachedFile struct {
+	Path   string `toml:"path"`
+	SHA256 string `toml:"sha256"`
+}
+
+type cachedEntity struct {
+	DefinitionFiles []string         `toml:"definitionFiles"`
+	Group           *GroupDefinition `toml:"group"`
+	User            *UserDefinition  `toml:"user"`
+}
+
+func pathToCacheFile() string {
+	return filepath.Join(os.Getenv("HOLO_CACHE_DIR"), "entities.toml")
+}
+
+//WriteScanCache stores the result of Scan() in the cache file.
+func WriteScanCache(entities []*Entity) error {
+	cache := scanCache{Version: scanCacheVersion}
+
+	files, err := digestDefinitionFiles()
+	if err != nil {
+		return err
+	}
+	cache.Files = files
+
+	for _, entity := range entities {
+		cached := cachedEntity{DefinitionFiles: entity.DefinitionFiles}
+		switch def := entity.Definition.(type) {
+		case *GroupDefinition:
+			cached.Group = def
+		case *UserDefinition:
+			cached.User = def
+		}
+		cache.Entities = append(cache.Entities, cached)
+	}
+
+	file, err := os.Create(pathToCacheFile())
+	if err != nil {
+		return err
+	}
+	err = toml.NewEncoder(file).Encode(cache)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//ReadScanCache returns the entities from the cache file. If the cache file is
+//missing or outdated, the definition files are scanned again (errors from this
+//scan are reported on stderr, like in the `scan` command).
+func ReadScanCache() ([]*Entity, error) {
+	entities, reason, err := readScanCache()
+	if err != nil {
+		return nil, err
+	}
+	if entities != nil {
+		return entities, nil
+	}
+
+	if reason != "" {
+		fmt.Fprintf(os.Stderr, "!! %s; scanning again\n", reason)
+	}
+	entities, errors := Scan()
+	for _, err := range errors {
+		fmt.Fprintf(os.Stderr, "!! %s\n", err.Error())
+	}
+	if entities == nil {
+		return nil, fmt.Errorf("scan failed")
+	}
+	return entities, WriteScanCache(entities)
+}
+
+//readScanCache returns nil entities if the cache cannot be used, and a reason
+//that shall be reported to the user (if any).
+func readScanCache() (entities []*Entity, reason string, err error) {
+	var cache scanCache
+	_, err = toml.DecodeFile(pathToCacheFile(), &cache)
+	if err != nil {
+		//a missing cache is not worth mentioning
+		if os.IsNotExist(err) {
+			return nil, "", nil
+		}
+		return nil, fmt.Sprintf("cannot read %s: %s", pathToCacheFile(), strings.TrimSuffix(err.Error(), ".")), nil
+	}
+	if cache.Version != scanCacheVersion {
+		return nil, fmt.Sprintf("%s was written by a different version of holo-users-groups", pathToCacheFile()), nil
+	}
+
+	//check that the definition files did not change since the scan
+	files, err := digestDefinitionFiles()
+	if err != nil {
+		return nil, "", err
+	}
+	cachedDigests := make(map[string]string)
+	for _, file := range cache.Files {
+		cachedDigests[file.Path] = file.SHA256
+	}
+	for _, file := range files {
+		digest, exists := cachedDigests[file.Path]
+		switch {
+		case !exists:
+			return nil, fmt.Sprintf("%s was added after the scan", file.Path), nil
+		case digest != file.SHA256:
+			return nil, fmt.Sprintf("%s was changed after the scan", file.Path), nil
+		}
+		delete(cachedDigests, file.Path)
+	}
+	for path := range cachedDigests {
+		return nil, fmt.Sprintf("%s was deleted after the scan", path), nil
+	}
+
+	//(the result must not be nil even if there are no entities, since that
+	//would be taken as a reason to scan again)
+	entities = make([]*Entity, 0, len(cache.Entities))
+	for _, cached := range cache.Entities {
+		entity := &Entity{DefinitionFiles: cached.DefinitionFiles}
+		switch {
+		case cached.Group != nil:
+			entity.Definition = cached.Group
+		case cached.User != nil:
+			entity.Definition = cached.User
+		default:
+			return nil, fmt.Sprintf("%s contains an entity without definition", pathToCacheFile()), nil
+		}
+		entities = append(entities, entity)
+	}
+	return entities, "", nil
+}
+
+//digestDefinitionFiles returns the SHA-256 digests of all definition files.
+func digestDefinitionFiles() ([]cachedFile, error) {
+	paths, err := findDefinitionFiles()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]cachedFile, 0, len(paths))
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(contents)
+		result = append(result, cachedFile{path, hex.EncodeToString(sum[:])})
+	}
+	return result, nil
+}
@@ -0,0 +1,294 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//EntityInvalidError contains the set of errors that were encountered while
+//checking an entity against other entities and the current account databases.
+type EntityInvalidError struct {
+	entity *Entity
+	errors []error
+}
+
+//Error implements the error interface.
+func (e *EntityInvalidError) Error() string {
+	str := fmt.Sprintf("Entity %s (defined in %s) is invalid:",
+		e.entity.Definition.EntityID(), strings.Join(e.entity.DefinitionFiles, ", "),
+	)
+	for _, suberr := range e.errors {
+		str += fmt.Sprintf("\n>> %s", suberr.Error())
+	}
+	return str
+}
+
+//checkConsistency cross-checks the definitions of all entities against each
+//other and against the current account databases, so that problems are found
+//before anything is applied, instead of halfway through. Entities that fail
+//these checks are marked as broken. (Groups are checked first since users can
+//only refer to groups that are not broken.)
+func checkConsistency(entities map[string]*Entity) []error {
+	var ids []string
+	for id, entity := range entities {
+		if !entity.IsBroken {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var groupIDs, userIDs []string
+	for _, id := range ids {
+		switch entities[id].Definition.(type) {
+		case *GroupDefinition:
+			groupIDs = append(groupIDs, id)
+		case *UserDefinition:
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	shells, err := readShells()
+	if err != nil {
+		return []error{err}
+	}
+
+	var result []error
+	check := func(id string, checkEntity func(*Entity) ([]error, error)) error {
+		entity := entities[id]
+		if entity.IsBroken {
+			return nil //already reported
+		}
+		errors, err := checkEntity(entity)
+		if err != nil {
+			return err
+		}
+		if len(errors) > 0 {
+			result = append(result, &EntityInvalidError{entity, errors})
+			entity.IsBroken = true
+		}
+		return nil
+	}
+
+	//an entity cannot be renamed from a name that is still defined, since
+	//both entities would then refer to the same account
+	for _, id := range ids {
+		err := check(id, func(entity *Entity) ([]error, error) {
+			return checkRenamedFrom(entities, entity), nil
+		})
+		if err != nil {
+			return []error{err}
+		}
+	}
+
+	//the numeric IDs are checked for all entities before any entity is marked
+	//as broken, so that duplicates are reported on both sides
+	gidOwners := numericIDOwners(entities, groupIDs)
+	for _, id := range groupIDs {
+		err := check(id, func(entity *Entity) ([]error, error) {
+			group := entity.Definition.(*GroupDefinition)
+			if group.GID == 0 {
+				return nil, nil
+			}
+			return checkNumericID(entities, entity, "GID", strconv.Itoa(group.GID), gidOwners, etcGroupPath, "group")
+		})
+		if err != nil {
+			return []error{err}
+		}
+	}
+
+	uidOwners := numericIDOwners(entities, userIDs)
+	for _, id := range userIDs {
+		err := check(id, func(entity *Entity) ([]error, error) {
+			user := entity.Definition.(*UserDefinition)
+			var errors []error
+
+			if user.UID != nil {
+				errs, err := checkNumericID(entities, entity, "UID", strconv.Itoa(*user.UID), uidOwners, etcPasswdPath, "passwd")
+				if err != nil {
+					return nil, err
+				}
+				errors = append(errors, errs...)
+			}
+
+			if user.Group != "" {
+				refErr, err := checkGroupReference(entities, "login group", user.Group)
+				if err != nil {
+					return nil, err
+				}
+				if refErr != nil {
+					errors = append(errors, refErr)
+				}
+			}
+			for _, groupName := range user.Groups {
+				refErr, err := checkGroupReference(entities, "auxiliary group", groupName)
+				if err != nil {
+					return nil, err
+				}
+				if refErr != nil {
+					errors = append(errors, refErr)
+				}
+			}
+
+			if user.Shell != "" && shells != nil && !shells[user.Shell] && !isNoLoginShell(user.Shell) {
+				errors = append(errors, fmt.Errorf("login shell %s is not listed in /etc/shells", user.Shell))
+			}
+			return errors, nil
+		})
+		if err != nil {
+			return []error{err}
+		}
+	}
+
+	return result
+}
+
+//checkRenamedFrom reports the previous names of the given entity that are
+//still defined by other entities.
+func checkRenamedFrom(entities map[string]*Entity, entity *Entity) []error {
+	var errors []error
+	_, previousNames := NamesOf(entity.Definition)
+	for _, previousName := range previousNames {
+		other, isDefined := entities[NewDefinitionLike(entity.Definition, previousName).EntityID()]
+		if isDefined {
+			errors = append(errors, fmt.Errorf("cannot be renamed from %s, which is still defined in %s",
+				other.Definition.EntityID(), strings.Join(other.DefinitionFiles, ", "),
+			))
+		}
+	}
+	return errors
+}
+
+//numericIDOwners maps each UID or GID that is declared by one of the given
+//entities to the names of the entities declaring it.
+func numericIDOwners(entities map[string]*Entity, ids []string) map[string][]string {
+	result := make(map[string][]string)
+	for _, id := range ids {
+		switch def := entities[id].Definition.(type) {
+		case *GroupDefinition:
+			if def.GID != 0 {
+				key := strconv.Itoa(def.GID)
+				result[key] = append(result[key], def.Name)
+			}
+		case *UserDefinition:
+			if def.UID != nil {
+				key := strconv.Itoa(*def.UID)
+				result[key] = append(result[key], def.Name)
+			}
+		}
+	}
+	return result
+}
+
+//checkNumericID reports if the UID or GID of the given entity is declared by
+//another entity as well, or if it belongs to an existing account that holo does
+//not manage. (Accounts that are managed by holo will be changed when their own
+//entities are applied, or removed if they are orphaned, but the latter only
+//helps if they are removed before this entity is applied.)
+func checkNumericID(entities map[string]*Entity, entity *Entity, field, value string, owners map[string][]string, databaseFile, database string) ([]error, error) {
+	def := entity.Definition
+	name, previousNames := NamesOf(def)
+	var errors []error
+	for _, owner := range owners[value] {
+		if owner != name {
+			errors = append(errors, fmt.Errorf("%s %s is also declared by %s", field, value, NewDefinitionLike(def, owner).EntityID()))
+		}
+	}
+
+	fields, _, err := lookupEntry(databaseFile, database, 2, value)
+	if err != nil || fields == nil {
+		return errors, err
+	}
+	owner := fields[0]
+	if owner == name || containsName(previousNames, owner) {
+		return errors, nil
+	}
+	ownerDef := NewDefinitionLike(def, owner)
+	if _, isDefined := entities[ownerDef.EntityID()]; isDefined {
+		return errors, nil
+	}
+	_, err = os.Stat(BaseImageDir.ImagePathFor(ownerDef))
+	switch {
+	case err == nil:
+		orphan := &Entity{Definition: ownerDef}
+		if orphan.ApplyOrder() < entity.ApplyOrder() {
+			return errors, nil
+		}
+		return append(errors, fmt.Errorf("%s %s is used by %s, which is only removed afterwards", field, value, ownerDef.EntityID())), nil
+	case os.IsNotExist(err):
+		return append(errors, fmt.Errorf("%s %s is already used by %s", field, value, ownerDef.EntityID())), nil
+	default:
+		return nil, err
+	}
+}
+
+//checkGroupReference checks whether a group that a user definition refers to
+//is defined by a valid entity, or exists already.
+func checkGroupReference(entities map[string]*Entity, description, groupName string) (error, error) {
+	entity, isDefined := entities["group:"+groupName]
+	if isDefined && !entity.IsBroken {
+		return nil, nil
+	}
+	fields, _, err := lookupEntry(etcGroupPath, "group", 0, groupName)
+	if err != nil || fields != nil {
+		return nil, err
+	}
+	if isDefined {
+		return fmt.Errorf("%s %s does not exist and its definition is invalid", description, groupName), nil
+	}
+	return fmt.Errorf("%s %s does not exist and is not defined", description, groupName), nil
+}
+
+//readShells returns the set of valid login shells from /etc/shells, or nil if
+//that file does not exist (in which case all shells are accepted).
+func readShells() (map[string]bool, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(rootDir, "etc/shells"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	result := make(map[string]bool)
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			result[line] = true
+		}
+	}
+	return result, nil
+}
+
+//isNoLoginShell recognizes shells that are used to disable logins. These are
+//usually not listed in /etc/shells on purpose.
+func isNoLoginShell(shell string) bool {
+	switch filepath.Base(shell) {
+	case "nologin", "false":
+		return true
+	}
+	return false
+}
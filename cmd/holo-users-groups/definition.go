@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015-2016 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -22,8 +23,10 @@ package entrypoint
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -115,14 +118,28 @@ func SerializeDefinitionIntoFile(def EntityDefinition, path string) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, bytes, 0644)
+	//password hashes must not be world-readable
+	mode := os.FileMode(0644)
+	if u, ok := def.(*UserDefinition); ok && u.Password != "" {
+		mode = 0600
+	}
+	err = ioutil.WriteFile(path, bytes, mode)
+	if err != nil {
+		return err
+	}
+	//WriteFile() does not change the mode of an existing file
+	return os.Chmod(path, mode)
 }
 
 //GroupDefinition represents a UNIX group (as registered in /etc/group).
 type GroupDefinition struct {
-	Name   string `toml:"name"`             //the group name (the first field in /etc/group)
-	GID    int    `toml:"gid,omitzero"`     //the GID (the third field in /etc/group), or 0 if no specific GID is enforced
-	System bool   `toml:"system,omitempty"` //whether the group is a system group (this influences the GID selection if GID = 0)
+	Name        string   `toml:"name"`                  //the group name (the first field in /etc/group)
+	GID         int      `toml:"gid,omitzero"`          //the GID (the third field in /etc/group), or 0 if no specific GID is enforced
+	System      bool     `toml:"system,omitempty"`      //whether the group is a system group (this influences the GID selection if GID = 0)
+	Members     []string `toml:"members,omitempty"`     //the names of users that are members of this group (the fourth field in /etc/group)
+	Admins      []string `toml:"admins,omitempty"`      //the names of users that are administrators of this group (the third field in /etc/gshadow)
+	RenamedFrom []string `toml:"renamedFrom,omitempty"` //previous names of this group (if a group with such a name exists, it is renamed instead of creating a new group)
+	Remote      bool     `toml:"-"`                     //whether GetProvisionedState() found this group in a name service other than /etc/group
 }
 
 //UserDefinition represents a UNIX user account (as registered in /etc/passwd).
@@ -132,10 +149,23 @@ type UserDefinition struct {
 	UID            *int     `toml:"uid,omitzero"`             //the user ID (the third field in /etc/passwd), or nil if no specific UID is enforced
 	System         bool     `toml:"system,omitempty"`         //whether the group is a system group (this influences the GID selection if gid = 0)
 	Home           string   `toml:"home,omitempty"`           //path to the user's home directory (or empty to use the default)
+	CreateHome     bool     `toml:"createHome,omitempty"`     //whether to create the home directory (and maintain its owner and mode)
+	HomeMode       string   `toml:"homeMode,omitempty"`       //the mode of the home directory as an octal string (or empty to use the default)
+	Skel           string   `toml:"skel,omitempty"`           //path to the skeleton directory for new home directories (or empty to use /etc/skel)
+	RemoveHome     bool     `toml:"removeHome,omitempty"`     //whether to remove the home directory when the user is scrubbed
 	Group          string   `toml:"group,omitempty"`          //the name of the user's initial login group (or empty to use the default)
 	Groups         []string `toml:"groups,omitempty"`         //the names of supplementary groups which the user is also a member of
 	Shell          string   `toml:"shell,omitempty"`          //path to the user's login shell (or empty to use the default)
+	Password       string   `toml:"password,omitempty"`       //the password hash in crypt(3) format (the second field in /etc/shadow, without the "!" that marks locked accounts)
+	Locked         *bool    `toml:"locked"`                   //whether the password is locked (with a "!" in /etc/shadow), or nil if not enforced
+	Expires        string   `toml:"expires,omitempty"`        //the account expiration date as "YYYY-MM-DD" or "never" (the eighth field in /etc/shadow)
+	MaxAge         *int     `toml:"maxAge"`                   //the maximum password age in days, or -1 for none (the fifth field in /etc/shadow)
+	Inactive       *int     `toml:"inactive"`                 //the number of days after password expiry until the account is disabled, or -1 for none (the seventh field in /etc/shadow)
+	SubUIDs        []string `toml:"subUIDs,omitempty"`        //ranges of subordinate UIDs as "FIRST-LAST" (from /etc/subuid)
+	SubGIDs        []string `toml:"subGIDs,omitempty"`        //ranges of subordinate GIDs as "FIRST-LAST" (from /etc/subgid)
 	SkipBaseGroups bool     `toml:"skipBaseGroups,omitempty"` //whether to consider supplementary groups in the base image during merging
+	RenamedFrom    []string `toml:"renamedFrom,omitempty"`    //previous names of this user (if a user with such a name exists, it is renamed instead of creating a new user)
+	Remote         bool     `toml:"-"`                        //whether GetProvisionedState() found this user in a name service other than /etc/passwd
 }
 
 //TypeName implements the EntityDefinition interface.
@@ -165,6 +195,15 @@ func (g *GroupDefinition) Attributes() string {
 	if g.GID > 0 {
 		attrs = append(attrs, fmt.Sprintf("GID: %d", g.GID))
 	}
+	if len(g.Members) > 0 {
+		attrs = append(attrs, "members: "+strings.Join(g.Members, ","))
+	}
+	if len(g.Admins) > 0 {
+		attrs = append(attrs, "admins: "+strings.Join(g.Admins, ","))
+	}
+	if len(g.RenamedFrom) > 0 {
+		attrs = append(attrs, "renamed from: "+strings.Join(g.RenamedFrom, ","))
+	}
 	return strings.Join(attrs, ", ")
 }
 
@@ -190,32 +229,163 @@ func (u *UserDefinition) Attributes() string {
 			attrs = append(attrs, "groups: "+strings.Join(u.Groups, ","))
 		}
 	}
+	if u.CreateHome {
+		homeAttr := "create home"
+		if u.HomeMode != "" {
+			homeAttr += " with mode " + u.HomeMode
+		}
+		if u.Skel != "" {
+			homeAttr += " from " + u.Skel
+		}
+		attrs = append(attrs, homeAttr)
+	}
+	if u.RemoveHome {
+		attrs = append(attrs, "remove home on scrub")
+	}
 	if u.Shell != "" {
 		attrs = append(attrs, "login shell: "+u.Shell)
 	}
 	if u.Comment != "" {
 		attrs = append(attrs, "comment: "+u.Comment)
 	}
+	if u.Password != "" {
+		attrs = append(attrs, "password: "+RedactPassword(u.Password))
+	}
+	if u.Locked != nil {
+		if *u.Locked {
+			attrs = append(attrs, "locked")
+		} else {
+			attrs = append(attrs, "unlocked")
+		}
+	}
+	if u.Expires != "" {
+		attrs = append(attrs, "expires: "+u.Expires)
+	}
+	if u.MaxAge != nil {
+		attrs = append(attrs, fmt.Sprintf("max. password age: %d", *u.MaxAge))
+	}
+	if u.Inactive != nil {
+		attrs = append(attrs, fmt.Sprintf("inactive after: %d", *u.Inactive))
+	}
+	if len(u.SubUIDs) > 0 {
+		attrs = append(attrs, "subordinate UIDs: "+strings.Join(u.SubUIDs, ","))
+	}
+	if len(u.SubGIDs) > 0 {
+		attrs = append(attrs, "subordinate GIDs: "+strings.Join(u.SubGIDs, ","))
+	}
+	if len(u.RenamedFrom) > 0 {
+		attrs = append(attrs, "renamed from: "+strings.Join(u.RenamedFrom, ","))
+	}
 	return strings.Join(attrs, ", ")
 }
 
+//RedactPassword returns a placeholder for the given password hash that can be
+//shown in diffs and error messages. It contains a fingerprint of the hash, so
+//that different hashes can still be told apart.
+func RedactPassword(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(hash))
+	return fmt.Sprintf("<redacted:%x>", sum[:4])
+}
+
+//WithScrubAttributes returns a copy of the actual state that also contains
+//those attributes of the desired state that are needed when the entity is
+//scrubbed (i.e. the `removeHome` flag of users), for storing in the
+//provisioned image.
+func WithScrubAttributes(actual, desired EntityDefinition) EntityDefinition {
+	u, ok := actual.(*UserDefinition)
+	if !ok || !desired.(*UserDefinition).RemoveHome {
+		return actual
+	}
+	result := *u
+	result.RemoveHome = true
+	return &result
+}
+
+//WithoutSecrets returns a version of the definition that can be shown to the
+//user, i.e. with password hashes redacted.
+func WithoutSecrets(def EntityDefinition) EntityDefinition {
+	if u, ok := def.(*UserDefinition); ok && u.Password != "" {
+		redacted := *u
+		redacted.Password = RedactPassword(u.Password)
+		return &redacted
+	}
+	return def
+}
+
+//NamesOf returns the name of the entity described by the given definition,
+//and the previous names from its `renamedFrom` attribute.
+func NamesOf(def EntityDefinition) (name string, previousNames []string) {
+	switch def := def.(type) {
+	case *GroupDefinition:
+		return def.Name, def.RenamedFrom
+	case *UserDefinition:
+		return def.Name, def.RenamedFrom
+	}
+	return "", nil
+}
+
+//IsRemote returns whether the given actual state (as returned by
+//GetProvisionedState) was found in a name service other than the files in
+///etc. Such entities can only be verified, but not modified.
+func IsRemote(def EntityDefinition) bool {
+	switch def := def.(type) {
+	case *GroupDefinition:
+		return def.Remote
+	case *UserDefinition:
+		return def.Remote
+	}
+	return false
+}
+
+//NewDefinitionLike returns an empty definition of the same type as the given
+//definition, with only the name set.
+func NewDefinitionLike(def EntityDefinition, name string) EntityDefinition {
+	if _, ok := def.(*GroupDefinition); ok {
+		return &GroupDefinition{Name: name}
+	}
+	return &UserDefinition{Name: name}
+}
+
+//WithName returns a copy of the given definition with a different name.
+func WithName(def EntityDefinition, name string) EntityDefinition {
+	switch def := def.(type) {
+	case *GroupDefinition:
+		result := *def
+		result.Name = name
+		return &result
+	case *UserDefinition:
+		result := *def
+		result.Name = name
+		return &result
+	}
+	return def
+}
+
 //WithSerializableState implements the EntityDefinition interface.
 func (g *GroupDefinition) WithSerializableState(callback func(EntityDefinition)) {
-	//we don't want to serialize the `system` attribute in diffs etc.
-	system := g.System
-	g.System = false
-	callback(g)
-	g.System = system
+	//we don't want to serialize the `system` and `renamedFrom` attributes in
+	//diffs etc.
+	state := *g
+	state.System = false
+	state.RenamedFrom = nil
+	callback(&state)
 }
 
 //WithSerializableState implements the EntityDefinition interface.
 func (u *UserDefinition) WithSerializableState(callback func(EntityDefinition)) {
-	//we don't want to serialize the `system` and `skipBaseGroups` attributes in diffs etc.
-	system := u.System
-	skipBaseGroups := u.SkipBaseGroups
-	u.System = false
-	u.SkipBaseGroups = false
-	callback(u)
-	u.System = system
-	u.SkipBaseGroups = skipBaseGroups
+	//we don't want to serialize the `system`, `skipBaseGroups` and
+	//`renamedFrom` attributes and the instructions for the home directory in
+	//diffs etc.
+	state := *u
+	state.System = false
+	state.SkipBaseGroups = false
+	state.CreateHome = false
+	state.HomeMode = ""
+	state.Skel = ""
+	state.RemoveHome = false
+	state.RenamedFrom = nil
+	callback(&state)
 }
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015-2017 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -21,6 +22,7 @@
 package entrypoint
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -38,9 +40,31 @@ func (e *Entity) IsOrphaned() bool {
 	return len(e.DefinitionFiles) == 0
 }
 
+//ApplyOrder returns the position of this entity in the order in which
+//entities are applied: Users are removed first (which frees their UIDs for
+//other users), then groups are created before users (so that users can be put
+//into them), and groups are removed last (so that they are not removed while
+//they are still the login group of some user that has not been updated yet).
+//Memberships are established last, together with the users that they belong
+//to (see reconcileMemberships).
+func (e *Entity) ApplyOrder() int {
+	_, isGroup := e.Definition.(*GroupDefinition)
+	switch {
+	case !isGroup && e.IsOrphaned():
+		return 10
+	case isGroup && !e.IsOrphaned():
+		return 20
+	case !isGroup && !e.IsOrphaned():
+		return 30
+	default:
+		return 40
+	}
+}
+
 //PrintReport prints the scan report for this entity on stdout.
 func (e *Entity) PrintReport() {
 	fmt.Printf("ENTITY: %s\n", e.Definition.EntityID())
+	fmt.Printf("ORDER: %d\n", e.ApplyOrder())
 	if e.IsOrphaned() {
 		fmt.Println("ACTION: Scrubbing (all definition files have been deleted)")
 	} else {
@@ -60,6 +84,12 @@ func (e *Entity) PrintReport() {
 func (e *Entity) Apply(withForce bool) error {
 	def := e.Definition
 
+	//if the entity was renamed, rename it on the system first
+	err := e.rename()
+	if err != nil {
+		return err
+	}
+
 	//check if this entity exists already
 	actualState, err := def.GetProvisionedState()
 	if err != nil {
@@ -73,11 +103,14 @@ func (e *Entity) Apply(withForce bool) error {
 			return err
 		}
 
-		//remove entity or reset to state of base image
-		if baseImage.IsProvisioned() {
+		//remove entity or reset to state of base image (unless the entity is
+		//only known to a name service where we cannot change it anyway)
+		if IsRemote(actualState) {
+			err = nil
+		} else if baseImage.IsProvisioned() {
 			err = baseImage.Apply(actualState)
 		} else {
-			err = def.Cleanup()
+			err = e.cleanup()
 		}
 		if err != nil {
 			return err
@@ -91,6 +124,11 @@ func (e *Entity) Apply(withForce bool) error {
 		return DeleteImageFor(def, BaseImageDir)
 	}
 
+	//entities from other name services (e.g. LDAP) can only be verified
+	if IsRemote(actualState) {
+		return e.verifyRemote(actualState)
+	}
+
 	//load base image
 	baseImage, err := BaseImageDir.LoadImageFor(e.Definition)
 	if err != nil {
@@ -163,7 +201,7 @@ func (e *Entity) Apply(withForce bool) error {
 		if err != nil {
 			return err
 		}
-		if string(desiredStr) == string(actualStr) {
+		if string(desiredStr) == string(actualStr) && !homeNeedsProvisioning(desiredState) {
 			PrintCommandMessage("not changed\n")
 			doNotApply = true
 		}
@@ -178,12 +216,85 @@ func (e *Entity) Apply(withForce bool) error {
 		StoreAppliedState(desiredState, actualState)
 	}
 
-	//record new actual state as provisioned state
+	//record new actual state as provisioned state (including the attributes
+	//that are needed to scrub the entity later)
 	actualState, err = def.GetProvisionedState()
 	if err != nil {
 		return fmt.Errorf("cannot read %s database: %s", def.TypeName(), err.Error())
 	}
-	return ProvisionedImageDir.SaveImage(actualState)
+	return ProvisionedImageDir.SaveImage(WithScrubAttributes(actualState, desiredState))
+}
+
+//verifyRemote checks that an entity that was found in a name service other
+//than the files in /etc conforms to the definition, since holo cannot modify
+//it.
+func (e *Entity) verifyRemote(actualState EntityDefinition) error {
+	_, conflicts := actualState.Merge(e.Definition, MergeEmptyOnly, SkipDisabled)
+	if len(conflicts) == 0 {
+		PrintCommandMessage("not changed\n")
+		return nil
+	}
+	msg := fmt.Sprintf("%s is not in /etc, but provided by a name service, and cannot be modified:", e.Definition.EntityID())
+	for _, err := range conflicts {
+		msg += "\n>> " + err.Error()
+	}
+	return errors.New(msg)
+}
+
+//rename renames an existing user or group whose name is listed in the
+//`renamedFrom` attribute of the definition (unless the entity exists under the
+//new name already), and moves its images to the new entity ID.
+func (e *Entity) rename() error {
+	newName, oldNames := NamesOf(e.Definition)
+	for _, oldName := range oldNames {
+		oldDef := NewDefinitionLike(e.Definition, oldName)
+		oldState, err := oldDef.GetProvisionedState()
+		if err != nil {
+			return fmt.Errorf("cannot read %s database: %s", oldDef.TypeName(), err.Error())
+		}
+
+		//(entities from other name services cannot be renamed by us)
+		if oldState.IsProvisioned() && !IsRemote(oldState) {
+			newState, err := e.Definition.GetProvisionedState()
+			if err != nil {
+				return fmt.Errorf("cannot read %s database: %s", oldDef.TypeName(), err.Error())
+			}
+			if newState.IsProvisioned() {
+				return fmt.Errorf("cannot rename %s %s to %s: both exist", oldDef.TypeName(), oldName, newName)
+			}
+
+			fmt.Printf(">> renaming %s %s to %s\n", oldDef.TypeName(), oldName, newName)
+			if _, ok := oldDef.(*GroupDefinition); ok {
+				err = backend.RenameGroup(oldName, newName)
+			} else {
+				err = backend.RenameUser(oldName, newName)
+			}
+			if err != nil {
+				return err
+			}
+			StoreRenamedState(oldState, oldName, newName)
+		}
+
+		err = MigrateImages(oldDef, newName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//cleanup removes an orphaned entity from the system. The provisioned image
+//(if any) is used for this, since it remembers how the entity shall be
+//scrubbed.
+func (e *Entity) cleanup() error {
+	provisionedImage, err := ProvisionedImageDir.LoadImageFor(e.Definition)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		provisionedImage = e.Definition
+	}
+	return provisionedImage.Cleanup()
 }
 
 //PrepareDiff creates temporary files that the frontend can use to generate a diff.
@@ -202,7 +313,7 @@ func (e *Entity) PrepareDiff() error {
 		return err
 	}
 	if actualState.IsProvisioned() {
-		err = SerializeDefinitionIntoFile(actualState, actualPath)
+		err = SerializeDefinitionIntoFile(WithoutSecrets(actualState), actualPath)
 		if err != nil {
 			return err
 		}
@@ -221,7 +332,7 @@ func (e *Entity) PrepareDiff() error {
 	}
 	desiredState, _ := e.Definition.Merge(baseState, MergeWhereCompatible, SkipDisabled)
 	desiredPath := filepath.Join(tempDir, "desired.toml")
-	err = SerializeDefinitionIntoFile(desiredState, desiredPath)
+	err = SerializeDefinitionIntoFile(WithoutSecrets(desiredState), desiredPath)
 	if err != nil {
 		return err
 	}
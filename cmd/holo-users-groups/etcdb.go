@@ -0,0 +1,367 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//etcDatabase is one of the colon-separated account databases in /etc
+//(passwd, group, shadow, gshadow, subuid or subgid), held in memory for editing.
+type etcDatabase struct {
+	path     string
+	exists   bool
+	original []byte
+	entries  [][]string
+	changed  bool
+	//ownership of the file, to be preserved when writing it
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+func readEtcDatabase(path string) (*etcDatabase, error) {
+	db := &etcDatabase{path: path, mode: 0644, uid: -1, gid: -1}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, err
+	}
+	db.original, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db.exists = true
+	db.mode = info.Mode().Perm()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		db.uid = int(stat.Uid)
+		db.gid = int(stat.Gid)
+	}
+
+	//each entry is one line, and fields are separated by colons (comments and
+	//NIS compat lines like "+::::::" are kept as they are, since their first
+	//field cannot be a valid name)
+	contents := strings.TrimSuffix(string(db.original), "\n")
+	if contents != "" {
+		for _, line := range strings.Split(contents, "\n") {
+			db.entries = append(db.entries, strings.Split(line, ":"))
+		}
+	}
+	return db, nil
+}
+
+//find returns a copy of the entry with the given name, padded to at least
+//numFields fields, or nil if there is no such entry.
+func (db *etcDatabase) find(name string, numFields int) []string {
+	return db.findBy(numFields, func(fields []string) bool { return fields[0] == name })
+}
+
+//findBy is like find, but returns the first entry matching the predicate. The
+//predicate is called with entries that are padded like the return value.
+func (db *etcDatabase) findBy(numFields int, predicate func([]string) bool) []string {
+	for _, entry := range db.entries {
+		fields := padFields(entry, numFields)
+		if predicate(fields) {
+			return fields
+		}
+	}
+	return nil
+}
+
+//each calls the action for each entry. If the action returns a non-nil slice,
+//the entry is replaced by it.
+func (db *etcDatabase) each(numFields int, action func([]string) []string) {
+	for idx, entry := range db.entries {
+		if replacement := action(padFields(entry, numFields)); replacement != nil {
+			db.entries[idx] = replacement
+			db.changed = true
+		}
+	}
+}
+
+//put replaces the entry with the same name as the given entry, or appends
+//it if there is no such entry yet.
+func (db *etcDatabase) put(fields []string) {
+	for idx, entry := range db.entries {
+		if entry[0] == fields[0] {
+			if strings.Join(entry, ":") != strings.Join(fields, ":") {
+				db.entries[idx] = fields
+				db.changed = true
+			}
+			return
+		}
+	}
+	db.entries = append(db.entries, fields)
+	db.changed = true
+}
+
+//add appends the given entry. Unlike put, it does not replace an existing
+//entry with the same name (in /etc/subuid and /etc/subgid, names are not
+//unique).
+func (db *etcDatabase) add(fields []string) {
+	db.entries = append(db.entries, fields)
+	db.changed = true
+}
+
+//removeWhere deletes all entries matching the predicate. The predicate is
+//called with entries that are padded like in findBy.
+func (db *etcDatabase) removeWhere(numFields int, predicate func([]string) bool) {
+	var kept [][]string
+	for _, entry := range db.entries {
+		if predicate(padFields(entry, numFields)) {
+			db.changed = true
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	db.entries = kept
+}
+
+//remove deletes the entry with the given name, if there is one.
+func (db *etcDatabase) remove(name string) {
+	for idx, entry := range db.entries {
+		if entry[0] == name {
+			db.entries = append(db.entries[:idx], db.entries[idx+1:]...)
+			db.changed = true
+			return
+		}
+	}
+}
+
+//write writes the database back to disk if it was changed. Like shadow-utils,
+//the previous version is kept as a backup in "$path-".
+func (db *etcDatabase) write() error {
+	if !db.changed {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range db.entries {
+		buf.WriteString(strings.Join(entry, ":"))
+		buf.WriteByte('\n')
+	}
+
+	if db.exists {
+		err := writeFileAtomically(db.path+"-", db.original, db.mode, db.uid, db.gid)
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomically(db.path, buf.Bytes(), db.mode, db.uid, db.gid)
+	if err != nil {
+		return err
+	}
+
+	db.exists = true
+	db.original = buf.Bytes()
+	db.changed = false
+	return nil
+}
+
+func padFields(fields []string, numFields int) []string {
+	result := make([]string, len(fields), len(fields)+numFields)
+	copy(result, fields)
+	for len(result) < numFields {
+		result = append(result, "")
+	}
+	return result
+}
+
+//writeFileAtomically writes the file at the given path via a temporary file
+//"$path+" (the same name that shadow-utils uses), which is synced to disk and
+//then renamed over the target, so that readers never see a partially written
+//database. A uid or gid of -1 leaves the respective owner unchanged.
+func writeFileAtomically(path string, contents []byte, mode os.FileMode, uid, gid int) error {
+	tempPath := path + "+"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(contents)
+	if err == nil {
+		//the mode given to OpenFile() is subject to the umask
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		err = file.Chown(uid, gid)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath) // this can fail silently
+		return err
+	}
+
+	//make the rename durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//lockTimeout is the time that lckpwdf(3) waits for the lock.
+const lockTimeout = 15 * time.Second
+
+//lockAccountDatabases takes the lock that lckpwdf(3) takes, i.e. a write lock
+//on /etc/.pwd.lock, so that we do not race with shadow-utils or other tools
+//that edit the account databases. The returned function releases the lock.
+func lockAccountDatabases(rootDir string) (unlock func(), err error) {
+	path := filepath.Join(rootDir, "etc/.pwd.lock")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+		if err == nil {
+			break
+		}
+		if (err != syscall.EAGAIN && err != syscall.EACCES) || time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("cannot lock %s: %s", path, err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	//closing the file releases the lock
+	return func() { file.Close() }, nil
+}
+
+//keyValueFile contains the settings from a file like /etc/login.defs or
+///etc/default/useradd.
+type keyValueFile map[string]string
+
+//readKeyValueFile reads a file like /etc/login.defs (with lines like "KEY
+//VALUE") or /etc/default/useradd (with lines like "KEY=VALUE"). A missing file
+//is treated like an empty file.
+func readKeyValueFile(path string) (keyValueFile, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	result := make(keyValueFile)
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == '=' || r == ' ' || r == '\t'
+		})
+		if len(fields) >= 2 {
+			result[fields[0]] = strings.Trim(fields[1], `"`)
+		}
+	}
+	return result, nil
+}
+
+//getInt returns the value of the given key as an integer, or the default
+//value if the key is unset or invalid.
+func (f keyValueFile) getInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(f[key])
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+//getBool returns whether the value of the given key is "yes", or the default
+//value if the key is unset.
+func (f keyValueFile) getBool(key string, defaultValue bool) bool {
+	value, ok := f[key]
+	if !ok {
+		return defaultValue
+	}
+	return strings.EqualFold(value, "yes")
+}
+
+//idRange returns the range of IDs that useradd(8) or groupadd(8) would
+//allocate from, according to the UID_MIN etc. settings in login.defs(5). The
+//kind is either "UID" or "GID".
+func (f keyValueFile) idRange(kind string, system bool) (min, max int) {
+	min = f.getInt(kind+"_MIN", 1000)
+	max = f.getInt(kind+"_MAX", 60000)
+	if system {
+		max = f.getInt("SYS_"+kind+"_MAX", min-1)
+		min = f.getInt("SYS_"+kind+"_MIN", 101)
+	}
+	return min, max
+}
+
+//allocateID picks a free ID from the given range like shadow-utils does:
+//System IDs are allocated downwards from the top of the range, other IDs are
+//allocated upwards after the highest ID that is already in use in the range.
+func allocateID(used map[int]bool, min, max int, system bool) (int, error) {
+	if system {
+		for id := max; id >= min; id-- {
+			if !used[id] {
+				return id, nil
+			}
+		}
+	} else {
+		highest := min - 1
+		for id := range used {
+			if id >= min && id <= max && id > highest {
+				highest = id
+			}
+		}
+		start := highest + 1
+		for id := start; id <= max; id++ {
+			if !used[id] {
+				return id, nil
+			}
+		}
+		//if the top of the range is exhausted, fill the gaps below
+		for id := min; id < start; id++ {
+			if !used[id] {
+				return id, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no free ID left in range %d-%d", min, max)
+}
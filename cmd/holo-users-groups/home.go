@@ -0,0 +1,336 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+//parseHomeMode parses the value of the `homeMode` attribute.
+func parseHomeMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid 'homeMode' attribute %q (expected an octal number like \"0700\")", value)
+	}
+	//convert setuid/setgid/sticky bits into their os.FileMode counterparts
+	result := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		result |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		result |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		result |= os.ModeSticky
+	}
+	return result, nil
+}
+
+//isManagedHome returns whether the given home directory may be created,
+//re-owned or removed by us.
+func isManagedHome(home string) bool {
+	return filepath.IsAbs(home) && filepath.Clean(home) != "/"
+}
+
+//homeNeedsProvisioning returns whether the home directory of the given user
+//has to be created or repaired, even though the user account itself is
+//already in the desired state.
+func homeNeedsProvisioning(def EntityDefinition) bool {
+	u, ok := def.(*UserDefinition)
+	if !ok || !u.CreateHome || !isManagedHome(u.Home) || u.UID == nil {
+		return false
+	}
+	info, err := os.Lstat(filepath.Join(rootDir, u.Home))
+	if err != nil {
+		return true
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || (canChown() && int(stat.Uid) != *u.UID) {
+		return true
+	}
+	if u.HomeMode != "" {
+		mode, err := parseHomeMode(u.HomeMode)
+		return err == nil && info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != mode
+	}
+	return false
+}
+
+//provisionHome is called after the user account has been applied. It creates
+//the home directory if requested, and fixes the ownership of its contents if
+//the UID or login group has changed (like usermod(8) does). The argument is
+//the state of the user account before it was applied.
+func (u *UserDefinition) provisionHome(previous *UserDefinition) error {
+	actual, err := u.GetProvisionedState()
+	if err != nil {
+		return err
+	}
+	state := actual.(*UserDefinition)
+	if !state.IsProvisioned() || !isManagedHome(state.Home) {
+		return nil
+	}
+	uid := *state.UID
+	gid, err := lookupGID(state.Group)
+	if err != nil {
+		return err
+	}
+	homePath := filepath.Join(rootDir, state.Home)
+
+	info, err := os.Lstat(homePath)
+	if os.IsNotExist(err) {
+		if !u.CreateHome {
+			return nil
+		}
+		return u.createHome(homePath, uid, gid)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("cannot use %s as home directory: not a directory", homePath)
+	}
+
+	//re-own the contents of the home directory if necessary
+	if previous.IsProvisioned() {
+		oldUID := *previous.UID
+		oldGID := gid
+		if previous.Group != "" && previous.Group != state.Group {
+			oldGID, err = lookupGID(previous.Group)
+			if err != nil {
+				return err
+			}
+		}
+		if oldUID != uid || oldGID != gid {
+			err = chownTree(homePath, oldUID, oldGID, uid, gid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//if we're managing the home directory, make sure that it has the right
+	//owner and mode
+	if !u.CreateHome {
+		return nil
+	}
+	err = lchown(homePath, uid, gid)
+	if err != nil {
+		return err
+	}
+	if u.HomeMode == "" {
+		return nil
+	}
+	mode, err := parseHomeMode(u.HomeMode)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(homePath, mode)
+}
+
+//createHome creates the home directory and populates it from the skeleton
+//directory.
+func (u *UserDefinition) createHome(homePath string, uid, gid int) error {
+	mode, err := u.defaultHomeMode()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(homePath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(homePath, mode)
+	if err == nil {
+		//the mode given to Mkdir() is subject to the umask
+		err = os.Chmod(homePath, mode)
+	}
+	if err == nil {
+		err = lchown(homePath, uid, gid)
+	}
+	if err != nil {
+		return err
+	}
+
+	skel := u.Skel
+	if skel == "" {
+		skel = "/etc/skel"
+	}
+	skelPath := filepath.Join(rootDir, skel)
+	if _, err := os.Stat(skelPath); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(skelPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == skelPath {
+			return err
+		}
+		relPath, err := filepath.Rel(skelPath, path)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(homePath, relPath)
+		err = copySkelEntry(path, targetPath, info)
+		if err != nil {
+			return err
+		}
+		return lchown(targetPath, uid, gid)
+	})
+}
+
+//defaultHomeMode returns the mode for a new home directory. Like useradd(8),
+//it is taken from HOME_MODE or UMASK in login.defs if not given explicitly.
+func (u *UserDefinition) defaultHomeMode() (os.FileMode, error) {
+	if u.HomeMode != "" {
+		return parseHomeMode(u.HomeMode)
+	}
+	loginDefs, err := readKeyValueFile(filepath.Join(rootDir, "etc/login.defs"))
+	if err != nil {
+		return 0, err
+	}
+	if value, ok := loginDefs["HOME_MODE"]; ok {
+		return parseHomeMode(value)
+	}
+	umask, err := strconv.ParseUint(loginDefs["UMASK"], 8, 32)
+	if err != nil {
+		umask = 022
+	}
+	return os.FileMode(0777 &^ umask), nil
+}
+
+//copySkelEntry copies a file, directory or symlink from the skeleton
+//directory into the home directory.
+func copySkelEntry(sourcePath, targetPath string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		err := os.Mkdir(targetPath, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		return os.Chmod(targetPath, info.Mode().Perm())
+	case info.Mode()&os.ModeSymlink != 0:
+		linkTarget, err := os.Readlink(sourcePath)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(linkTarget, targetPath)
+	case info.Mode().IsRegular():
+		source, err := os.Open(sourcePath)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		target, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(target, source)
+		if err == nil {
+			err = target.Chmod(info.Mode().Perm())
+		}
+		if closeErr := target.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	default:
+		//skip device files, sockets etc.
+		return nil
+	}
+}
+
+//chownTree changes the owner of all files below the given path that belong
+//to the old UID or old GID.
+func chownTree(path string, oldUID, oldGID, newUID, newGID int) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		uid, gid := -1, -1
+		if int(stat.Uid) == oldUID {
+			uid = newUID
+		}
+		if int(stat.Gid) == oldGID {
+			gid = newGID
+		}
+		if uid == -1 && gid == -1 {
+			return nil
+		}
+		return lchown(path, uid, gid)
+	})
+}
+
+//removeHome removes the home directory of a user that is being scrubbed, if
+//the user definition requested that.
+func (u *UserDefinition) removeHome() error {
+	if !u.RemoveHome || !isManagedHome(u.Home) || u.UID == nil {
+		return nil
+	}
+	homePath := filepath.Join(rootDir, u.Home)
+	info, err := os.Lstat(homePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	//do not remove directories that belong to someone else (e.g. when the
+	//home directory has been changed to something like /var/lib), but do
+	//not fail the scrubbing because of that either
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != *u.UID {
+		fmt.Fprintf(os.Stderr, "!! not removing %s: not a directory owned by user %s\n", homePath, u.Name)
+		return nil
+	}
+	return os.RemoveAll(homePath)
+}
+
+//canChown returns false when an unprivileged process provisions a root
+//directory other than "/" (e.g. during tests), since file owners cannot be
+//changed in this case.
+func canChown() bool {
+	return rootDir == "/" || os.Geteuid() == 0
+}
+
+//lchown is like os.Lchown, but does nothing if !canChown().
+func lchown(path string, uid, gid int) error {
+	if !canChown() {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+//lookupGID returns the numeric ID of the given group.
+func lookupGID(groupName string) (int, error) {
+	fields, err := Getent(etcGroupPath, func(fields []string) bool { return fields[0] == groupName })
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("group %s does not exist", groupName)
+	}
+	return strconv.Atoi(fields[2])
+}
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015-2016 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -21,10 +22,8 @@
 package entrypoint
 
 import (
-	"encoding/gob"
 	"fmt"
 	"os"
-	"path/filepath"
 )
 
 // Main is the main entry point, but returns the exit code rather than
@@ -46,11 +45,21 @@ func Main() (exitCode int) {
 		}
 	}
 
-	gob.Register(&GroupDefinition{})
-	gob.Register(&UserDefinition{})
-	gob.Register(Entity{})
-
 	var err error
+	backend, err = SelectBackend(os.Getenv("HOLO_USERS_GROUPS_BACKEND"), rootDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! %s\n", err.Error())
+		return 1
+	}
+	err = SelectNSS(os.Getenv("HOLO_USERS_GROUPS_NSS"), rootDir, os.Getenv("HOLO_USERS_GROUPS_NSS_FORCE") == "1")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!! %s\n", err.Error())
+		return 1
+	}
+	if b, ok := backend.(shadowUtilsBackend); ok && b.mock {
+		appliedStates = make(map[string]EntityDefinition)
+	}
+
 	switch os.Args[1] {
 	case "info":
 		os.Stdout.Write([]byte("MIN_API_VERSION=3\nMAX_API_VERSION=3\n"))
@@ -67,10 +76,6 @@ func Main() (exitCode int) {
 	return 0
 }
 
-func pathToCacheFile() string {
-	return filepath.Join(os.Getenv("HOLO_CACHE_DIR"), "entities.toml")
-}
-
 func executeScanCommand() error {
 	//scan for entities
 	entities, errors := Scan()
@@ -88,29 +93,12 @@ func executeScanCommand() error {
 	}
 
 	//store scan result in cache
-	file, err := os.Create(pathToCacheFile())
-	if err != nil {
-		return err
-	}
-	err = gob.NewEncoder(file).Encode(entities)
-	if err != nil {
-		return err
-	}
-	return file.Close()
+	return WriteScanCache(entities)
 }
 
 func executeNonScanCommand() error {
-	//retrieve entities from cache
-	file, err := os.Open(pathToCacheFile())
-	if err != nil {
-		return err
-	}
-	var entities []*Entity
-	err = gob.NewDecoder(file).Decode(&entities)
-	if err != nil {
-		return err
-	}
-	err = file.Close()
+	//retrieve entities from cache (or scan again if necessary)
+	entities, err := ReadScanCache()
 	if err != nil {
 		return err
 	}
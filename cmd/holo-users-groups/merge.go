@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015-2016 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -69,9 +70,48 @@ func (g *GroupDefinition) Merge(other EntityDefinition, mMethod MergeMethod, sMe
 	//the system flag can be set by any side without causing a merge conflict
 	result.System = result.System || g.System
 
+	//members and administrators are merged like the auxiliary groups of users
+	var errs []error
+	result.Members, errs = mergeLists(result.Members, g.Members, "members", g.EntityID(), mMethod)
+	e = append(e, errs...)
+	result.Admins, errs = mergeLists(result.Admins, g.Admins, "administrators", g.EntityID(), mMethod)
+	e = append(e, errs...)
+
+	//previous names are never in conflict (they do not describe the state of
+	//the entity anyway)
+	result.RenamedFrom, _ = mergeLists(result.RenamedFrom, g.RenamedFrom, "previous names", g.EntityID(), MergeWhereCompatible)
+
 	return &result, e
 }
 
+//mergeLists merges the callee's list of names (or ranges) into the other
+//side's list. With MergeWhereCompatible, all entries are collected. With
+//MergeEmptyOnly, the lists may only be merged if one of them is empty.
+func mergeLists(result, callee []string, field, entityID string, mMethod MergeMethod) ([]string, []error) {
+	var e []error
+	if mMethod == MergeEmptyOnly {
+		if len(result) > 0 && len(callee) > 0 {
+			sort.Strings(result)
+			sort.Strings(callee)
+			resultStr := strings.Join(result, ",")
+			calleeStr := strings.Join(callee, ",")
+			if resultStr != calleeStr {
+				e = append(e, &MergeError{field, entityID, resultStr, calleeStr})
+			}
+		}
+		if len(callee) > 0 {
+			result = callee
+		}
+	} else {
+		for _, name := range callee {
+			result, _ = appendIfMissing(result, name)
+		}
+	}
+	//make sure that the list is always sorted (esp. for reproducible test output)
+	sort.Strings(result)
+	return result, e
+}
+
 //Merge implements the EntityDefinition interface.
 func (u *UserDefinition) Merge(other EntityDefinition, mMethod MergeMethod, sMethod SkipMethod) (EntityDefinition, []error) {
 	//start by cloning `other`
@@ -122,9 +162,78 @@ func (u *UserDefinition) Merge(other EntityDefinition, mMethod MergeMethod, sMet
 		result.Comment = u.Comment
 	}
 
+	//password attributes (hashes are redacted in the error message)
+	if u.Password != "" {
+		if result.Password != "" && result.Password != u.Password {
+			e = append(e, &MergeError{"password", u.EntityID(), RedactPassword(result.Password), RedactPassword(u.Password)})
+		}
+		//a new password is unlocked unless the callee says otherwise (in
+		//particular, accounts without a password are always locked, but
+		//that does not mean that their new password shall be locked)
+		if result.Password != u.Password && u.Locked == nil {
+			result.Locked = nil
+		}
+		result.Password = u.Password
+	}
+	if u.Locked != nil {
+		if result.Locked != nil && *result.Locked != *u.Locked {
+			e = append(e, &MergeError{"locked flag", u.EntityID(), *result.Locked, *u.Locked})
+		}
+		value := *u.Locked
+		result.Locked = &value
+	}
+	if u.Expires != "" {
+		if result.Expires != "" && result.Expires != u.Expires {
+			e = append(e, &MergeError{"expiration date", u.EntityID(), result.Expires, u.Expires})
+		}
+		result.Expires = u.Expires
+	}
+	if u.MaxAge != nil {
+		if result.MaxAge != nil && *result.MaxAge != *u.MaxAge {
+			e = append(e, &MergeError{"max. password age", u.EntityID(), *result.MaxAge, *u.MaxAge})
+		}
+		value := *u.MaxAge
+		result.MaxAge = &value
+	}
+	if u.Inactive != nil {
+		if result.Inactive != nil && *result.Inactive != *u.Inactive {
+			e = append(e, &MergeError{"inactivity period", u.EntityID(), *result.Inactive, *u.Inactive})
+		}
+		value := *u.Inactive
+		result.Inactive = &value
+	}
+
 	//the system flag can be set by any side without causing a merge conflict
 	result.System = result.System || u.System
 
+	//same for the flags concerning the home directory
+	result.CreateHome = result.CreateHome || u.CreateHome
+	result.RemoveHome = result.RemoveHome || u.RemoveHome
+	if u.HomeMode != "" {
+		if result.HomeMode != "" && result.HomeMode != u.HomeMode {
+			e = append(e, &MergeError{"home directory mode", u.EntityID(), result.HomeMode, u.HomeMode})
+		}
+		result.HomeMode = u.HomeMode
+	}
+	if u.Skel != "" {
+		if result.Skel != "" && result.Skel != u.Skel {
+			e = append(e, &MergeError{"skeleton directory", u.EntityID(), result.Skel, u.Skel})
+		}
+		result.Skel = u.Skel
+	}
+
+	//subordinate ID ranges are merged like the auxiliary groups below (but
+	//SkipBaseGroups does not apply to them)
+	var errs []error
+	result.SubUIDs, errs = mergeLists(result.SubUIDs, u.SubUIDs, "subordinate UIDs", u.EntityID(), mMethod)
+	e = append(e, errs...)
+	result.SubGIDs, errs = mergeLists(result.SubGIDs, u.SubGIDs, "subordinate GIDs", u.EntityID(), mMethod)
+	e = append(e, errs...)
+
+	//previous names are never in conflict (they do not describe the state of
+	//the entity anyway)
+	result.RenamedFrom, _ = mergeLists(result.RenamedFrom, u.RenamedFrom, "previous names", u.EntityID(), MergeWhereCompatible)
+
 	//auxiliary groups can always be added, but only under the
 	//MergeWhereCompatible method
 	if mMethod == MergeEmptyOnly {
@@ -0,0 +1,95 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+//nssLookup looks up an entry in a name service database ("passwd" or "group")
+//by name or numeric ID. The entry is returned as a list of fields like in the
+//respective file in /etc, or nil if there is no such entry. If nil, the
+//configured name services are not consulted at all (only the files in /etc).
+var nssLookup func(database, key string) ([]string, error)
+
+//SelectNSS chooses how the configured name services (see nsswitch.conf(5))
+//are consulted for users and groups that are not in /etc/passwd and
+///etc/group, according to the value of $HOLO_USERS_GROUPS_NSS, which is
+//either "getent", "libc" or "off" (the default). The name services are
+//always those of the running system, so they are refused for other root
+//directories (which are usually image root filesystems) unless force is set.
+func SelectNSS(name, rootDir string, force bool) error {
+	switch name {
+	case "", "off":
+		nssLookup = nil
+		return nil
+	case "getent":
+		nssLookup = getentLookup
+	case "libc":
+		nssLookup = libcLookup
+	default:
+		return fmt.Errorf("invalid value for $HOLO_USERS_GROUPS_NSS: %q (valid values are \"getent\", \"libc\" and \"off\")", name)
+	}
+	if rootDir != "/" && !force {
+		nssLookup = nil
+		return fmt.Errorf("$HOLO_USERS_GROUPS_NSS=%s consults the name services of the running system, which usually do not describe the users and groups in %s (set $HOLO_USERS_GROUPS_NSS_FORCE=1 if they do)", name, rootDir)
+	}
+	return nil
+}
+
+//getentLookup implements nssLookup by calling getent(1).
+func getentLookup(database, key string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("getent", database, key)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		//exit code 2 means that the key was not found
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 2 {
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("getent %s %s failed: %s %s", database, key, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	line := strings.SplitN(strings.TrimSpace(stdout.String()), "\n", 2)[0]
+	return strings.Split(line, ":"), nil
+}
+
+//lookupEntry finds the entry with the given name or numeric ID in the given
+//database file (/etc/passwd or /etc/group). If it is not there, the configured
+//name services are consulted (if enabled), in which case the returned entry is
+//marked as remote.
+func lookupEntry(databaseFile, database string, keyField int, key string) (fields []string, remote bool, err error) {
+	fields, err = Getent(databaseFile, func(fields []string) bool {
+		return len(fields) > keyField && fields[keyField] == key
+	})
+	if err != nil || fields != nil || nssLookup == nil {
+		return fields, false, err
+	}
+	fields, err = nssLookup(database, key)
+	return fields, fields != nil, err
+}
@@ -0,0 +1,104 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+//#include <sys/types.h>
+//#include <grp.h>
+//#include <pwd.h>
+//#include <stdlib.h>
+import "C"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+//libcLookup implements nssLookup with getpwnam_r(3) and friends.
+func libcLookup(database, key string) ([]string, error) {
+	//retry with larger buffers until the entry fits
+	for bufSize := 4096; bufSize <= 1<<20; bufSize *= 4 {
+		buf := C.malloc(C.size_t(bufSize))
+		fields, errno := libcLookupWithBuffer(database, key, (*C.char)(buf), C.size_t(bufSize))
+		C.free(buf)
+		if errno != syscall.ERANGE {
+			if errno != 0 {
+				return nil, fmt.Errorf("cannot look up %s in %s database: %s", key, database, errno.Error())
+			}
+			return fields, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot look up %s in %s database: entry too large", key, database)
+}
+
+func libcLookupWithBuffer(database, key string, buf *C.char, bufSize C.size_t) ([]string, syscall.Errno) {
+	id, err := strconv.Atoi(key)
+	isID := err == nil
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+
+	switch database {
+	case "passwd":
+		pwd := (*C.struct_passwd)(C.malloc(C.sizeof_struct_passwd))
+		defer C.free(unsafe.Pointer(pwd))
+		var result *C.struct_passwd
+		var rc C.int
+		if isID {
+			rc = C.getpwuid_r(C.uid_t(id), pwd, buf, bufSize, &result)
+		} else {
+			rc = C.getpwnam_r(cKey, pwd, buf, bufSize, &result)
+		}
+		if rc != 0 || result == nil {
+			return nil, syscall.Errno(rc)
+		}
+		return []string{
+			C.GoString(pwd.pw_name), "x",
+			strconv.Itoa(int(pwd.pw_uid)), strconv.Itoa(int(pwd.pw_gid)),
+			C.GoString(pwd.pw_gecos), C.GoString(pwd.pw_dir), C.GoString(pwd.pw_shell),
+		}, 0
+
+	case "group":
+		grp := (*C.struct_group)(C.malloc(C.sizeof_struct_group))
+		defer C.free(unsafe.Pointer(grp))
+		var result *C.struct_group
+		var rc C.int
+		if isID {
+			rc = C.getgrgid_r(C.gid_t(id), grp, buf, bufSize, &result)
+		} else {
+			rc = C.getgrnam_r(cKey, grp, buf, bufSize, &result)
+		}
+		if rc != 0 || result == nil {
+			return nil, syscall.Errno(rc)
+		}
+		//gr_mem is a NULL-terminated array of strings
+		var members []string
+		for ptr := grp.gr_mem; *ptr != nil; ptr = (**C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(ptr)) + unsafe.Sizeof(*ptr))) {
+			members = append(members, C.GoString(*ptr))
+		}
+		return []string{
+			C.GoString(grp.gr_name), "x",
+			strconv.Itoa(int(grp.gr_gid)), strings.Join(members, ","),
+		}, 0
+	}
+
+	return nil, syscall.EINVAL
+}
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015-2016 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -22,35 +23,44 @@ package entrypoint
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	etcPasswdPath string
-	etcGroupPath  string
-	appliedStates map[string]EntityDefinition //= nil unless during tests
+	rootDir        string
+	etcPasswdPath  string
+	etcGroupPath   string
+	etcShadowPath  string
+	etcGShadowPath string
+	etcSubUIDPath  string
+	etcSubGIDPath  string
+	appliedStates  map[string]EntityDefinition //= nil unless during tests
 )
 
 func init() {
-	rootDir := os.Getenv("HOLO_ROOT_DIR")
+	rootDir = os.Getenv("HOLO_ROOT_DIR")
 	if rootDir == "" {
 		rootDir = "/"
 	}
 	etcPasswdPath = filepath.Join(rootDir, "etc/passwd")
 	etcGroupPath = filepath.Join(rootDir, "etc/group")
-	if rootDir != "/" {
-		appliedStates = make(map[string]EntityDefinition)
-	}
+	etcShadowPath = filepath.Join(rootDir, "etc/shadow")
+	etcGShadowPath = filepath.Join(rootDir, "etc/gshadow")
+	etcSubUIDPath = filepath.Join(rootDir, "etc/subuid")
+	etcSubGIDPath = filepath.Join(rootDir, "etc/subgid")
 }
 
-//StoreAppliedState is a no-op during normal operation. During unit tests, it
-//records Apply()ed definitions, so that the next GetProvisionedState() of the
-//same entity will present a consistent result.
+//StoreAppliedState is a no-op during normal operation. During unit tests with
+//the mocked shadow-utils backend, it records Apply()ed definitions, so that
+//the next GetProvisionedState() of the same entity will present a consistent
+//result.
 //
 //The `previous` argument contains the actual state before the apply operation.
 func StoreAppliedState(def EntityDefinition, previous EntityDefinition) {
@@ -76,6 +86,16 @@ func StoreAppliedState(def EntityDefinition, previous EntityDefinition) {
 	}
 }
 
+//StoreRenamedState is like StoreAppliedState, but records that the entity
+//with the given actual state was renamed from oldName to newName.
+func StoreRenamedState(previous EntityDefinition, oldName, newName string) {
+	if appliedStates != nil {
+		appliedStates[previous.EntityID()] = NewDefinitionLike(previous, oldName)
+		renamed := WithName(previous, newName)
+		appliedStates[renamed.EntityID()] = renamed
+	}
+}
+
 //Getent reads entries from a UNIX user/group database (e.g. /etc/passwd
 //or /etc/group) and returns the first entry matching the given predicate.
 //For example, to locate the user with name "foo":
@@ -104,6 +124,26 @@ func Getent(databaseFile string, predicate func([]string) bool) ([]string, error
 	return nil, nil
 }
 
+//GetentAll is like Getent, but returns all entries matching the given
+//predicate. This is needed for databases like /etc/subuid where the same name
+//can appear in multiple entries.
+func GetentAll(databaseFile string, predicate func([]string) bool) ([][]string, error) {
+	//read database file
+	contents, err := ioutil.ReadFile(databaseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var result [][]string
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if predicate(fields) {
+			result = append(result, fields)
+		}
+	}
+	return result, nil
+}
+
 //GetProvisionedState implements the EntityDefinition interface.
 func (g *GroupDefinition) GetProvisionedState() (EntityDefinition, error) {
 	//special case for test runs
@@ -113,8 +153,8 @@ func (g *GroupDefinition) GetProvisionedState() (EntityDefinition, error) {
 		}
 	}
 
-	//fetch entry from /etc/group
-	fields, err := Getent(etcGroupPath, func(fields []string) bool { return fields[0] == g.Name })
+	//fetch entry from /etc/group (or from NSS)
+	fields, remote, err := lookupEntry(etcGroupPath, "group", 0, g.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -129,10 +169,69 @@ func (g *GroupDefinition) GetProvisionedState() (EntityDefinition, error) {
 
 	//read fields in entry
 	gid, err := strconv.Atoi(fields[2])
-	return &GroupDefinition{
-		Name: fields[0],
-		GID:  gid,
-	}, err
+	if err != nil {
+		return nil, err
+	}
+	result := &GroupDefinition{
+		Name:   fields[0],
+		GID:    gid,
+		Remote: remote,
+	}
+
+	//read administrators from /etc/gshadow (if it exists and we're allowed to
+	//read it; otherwise the administrators are just unknown)
+	var admins []string
+	gshadowFields, err := Getent(etcGShadowPath, func(fields []string) bool { return fields[0] == g.Name })
+	if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+		return nil, err
+	}
+	if gshadowFields != nil {
+		if len(gshadowFields) < 4 {
+			return nil, errors.New("invalid entry in /etc/gshadow (not enough fields)")
+		}
+		admins = splitList(gshadowFields[2])
+	}
+
+	//memberships are not owned by the group alone (users can be added to a
+	//group by their own definitions, or by the administrator), so only report
+	//those members and administrators that the definition is concerned with,
+	//i.e. that it declares now or that it declared when it was last applied
+	var previous *GroupDefinition
+	if image, err := ProvisionedImageDir.LoadImageFor(g); err == nil {
+		previous = image.(*GroupDefinition)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else {
+		previous = &GroupDefinition{}
+	}
+	result.Members = filterNames(splitList(fields[3]), g.Members, previous.Members)
+	result.Admins = filterNames(admins, g.Admins, previous.Admins)
+	return result, nil
+}
+
+//filterNames returns those names from the first list that appear in any of
+//the other lists.
+func filterNames(names []string, relevant ...[]string) []string {
+	var result []string
+	for _, name := range names {
+		for _, list := range relevant {
+			if containsName(list, name) {
+				result = append(result, name)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func containsName(list []string, name string) bool {
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
 }
 
 //GetProvisionedState implements the EntityDefinition interface.
@@ -144,8 +243,8 @@ func (u *UserDefinition) GetProvisionedState() (EntityDefinition, error) {
 		}
 	}
 
-	//fetch entry from /etc/passwd
-	fields, err := Getent(etcPasswdPath, func(fields []string) bool { return fields[0] == u.Name })
+	//fetch entry from /etc/passwd (or from NSS)
+	fields, remote, err := lookupEntry(etcPasswdPath, "passwd", 0, u.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -164,15 +263,9 @@ func (u *UserDefinition) GetProvisionedState() (EntityDefinition, error) {
 		return nil, err
 	}
 
-	//fetch entry for login group from /etc/group (to resolve actualGID into a
-	//group name)
-	actualGIDString := fields[3]
-	groupFields, err := Getent(etcGroupPath, func(fields []string) bool {
-		if len(fields) <= 2 {
-			return false
-		}
-		return fields[2] == actualGIDString
-	})
+	//fetch entry for login group from /etc/group or NSS (to resolve actualGID
+	//into a group name)
+	groupFields, _, err := lookupEntry(etcGroupPath, "group", 2, fields[3])
 	if err != nil {
 		return nil, err
 	}
@@ -204,7 +297,7 @@ func (u *UserDefinition) GetProvisionedState() (EntityDefinition, error) {
 	//make sure that the groups list is always sorted (esp. for reproducible test output)
 	sort.Strings(groupNames)
 
-	return &UserDefinition{
+	result := &UserDefinition{
 		Name:    fields[0],
 		Comment: fields[4],
 		UID:     &actualUID,
@@ -212,5 +305,74 @@ func (u *UserDefinition) GetProvisionedState() (EntityDefinition, error) {
 		Group:   groupName,
 		Groups:  groupNames,
 		Shell:   fields[6],
-	}, nil
+		Remote:  remote,
+	}
+
+	//fetch entry from /etc/shadow (if it exists and we're allowed to read it;
+	//otherwise the password attributes are just unknown)
+	shadowFields, err := Getent(etcShadowPath, func(fields []string) bool { return fields[0] == u.Name })
+	if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+		return nil, err
+	}
+	if shadowFields != nil {
+		if len(shadowFields) < 8 {
+			return nil, errors.New("invalid entry in /etc/shadow (not enough fields)")
+		}
+		locked := strings.HasPrefix(shadowFields[1], "!")
+		result.Password = strings.TrimPrefix(shadowFields[1], "!")
+		result.Locked = &locked
+		result.Expires = shadowDaysToDate(shadowFields[7])
+		if result.MaxAge, err = parseShadowDays(shadowFields[4]); err != nil {
+			return nil, err
+		}
+		if result.Inactive, err = parseShadowDays(shadowFields[6]); err != nil {
+			return nil, err
+		}
+	}
+
+	//fetch subordinate ID ranges from /etc/subuid and /etc/subgid
+	if result.SubUIDs, err = readSubIDRanges(etcSubUIDPath, u.Name, fields[2]); err != nil {
+		return nil, err
+	}
+	if result.SubGIDs, err = readSubIDRanges(etcSubGIDPath, u.Name, fields[2]); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//parseShadowDays parses a numeric field from /etc/shadow. An empty field
+//(i.e. no limit) is reported as -1.
+func parseShadowDays(field string) (*int, error) {
+	value := -1
+	if field != "" {
+		var err error
+		value, err = strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry in /etc/shadow (%s)", err.Error())
+		}
+	}
+	return &value, nil
+}
+
+//shadowDaysToDate converts a date from /etc/shadow (in days since the epoch)
+//into the "YYYY-MM-DD" format used in entity definitions.
+func shadowDaysToDate(field string) string {
+	days, err := strconv.ParseInt(field, 10, 64)
+	if err != nil {
+		return "never"
+	}
+	return time.Unix(days*86400, 0).UTC().Format("2006-01-02")
+}
+
+//dateToShadowDays is the inverse of shadowDaysToDate.
+func dateToShadowDays(date string) (string, error) {
+	if date == "never" {
+		return "", nil
+	}
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return "", fmt.Errorf("invalid expiration date %q (expected YYYY-MM-DD or \"never\")", date)
+	}
+	return strconv.FormatInt(t.Unix()/86400, 10), nil
 }
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2016 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -99,7 +100,57 @@ func (dir ImageDir) LoadImageFor(def EntityDefinition) (EntityDefinition, error)
 
 //SaveImage writes an image for this entity to the specified image directory.
 func (dir ImageDir) SaveImage(def EntityDefinition) error {
-	return SerializeDefinitionIntoFile(def, dir.ImagePathFor(def))
+	path := dir.ImagePathFor(def)
+	err := SerializeDefinitionIntoFile(def, path)
+	if err != nil {
+		return err
+	}
+
+	//SerializeDefinition() omits the `removeHome` flag (since it's not part of
+	//the entity's state, and thus not interesting for diffs), but we need to
+	//remember it for when the entity is scrubbed
+	if u, ok := def.(*UserDefinition); ok && u.RemoveHome {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write([]byte("removeHome = true\n"))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return nil
+}
+
+//MigrateImages moves the base image and provisioned image of an entity that
+//was renamed to the entity ID for the new name. If there are images for the new entity ID
+//already, the old images are discarded instead.
+func MigrateImages(oldDef EntityDefinition, newName string) error {
+	newDef := NewDefinitionLike(oldDef, newName)
+	for _, dir := range []ImageDir{BaseImageDir, ProvisionedImageDir} {
+		image, err := dir.LoadImageFor(oldDef)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		_, err = os.Stat(dir.ImagePathFor(newDef))
+		if os.IsNotExist(err) {
+			err = dir.SaveImage(WithName(image, newName))
+		}
+		if err != nil {
+			return err
+		}
+
+		err = DeleteImageFor(oldDef, dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //DeleteImageFor deletes the image for this entity from this image directory.
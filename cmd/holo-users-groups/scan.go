@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -39,26 +40,12 @@ func Scan() ([]*Entity, []error) {
 		return nil, []error{err}
 	}
 
-	//open resource directory
-	dirPath := os.Getenv("HOLO_RESOURCE_DIR")
-	dir, err := os.Open(dirPath)
-	if err != nil {
-		return nil, []error{err}
-	}
-	fis, err := dir.Readdir(-1)
+	//find entity definitions
+	paths, err := findDefinitionFiles()
 	if err != nil {
 		return nil, []error{err}
 	}
 
-	//find entity definitions
-	var paths []string
-	for _, fi := range fis {
-		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".toml") {
-			paths = append(paths, filepath.Join(dirPath, fi.Name()))
-		}
-	}
-	sort.Strings(paths)
-
 	//parse entity definitions
 	entities := make(map[string]*Entity)
 	var errors []error
@@ -69,6 +56,12 @@ func Scan() ([]*Entity, []error) {
 		}
 	}
 
+	//memberships can be declared on both the user and the group side
+	errors = append(errors, reconcileMemberships(entities)...)
+
+	//check that the definitions fit together and fit the current system
+	errors = append(errors, checkConsistency(entities)...)
+
 	//find orphaned entities (invalid entities are considered "existing" here,
 	//so that we don't remove entities that are still needed just because their
 	//definition file is broken)
@@ -76,7 +69,19 @@ func Scan() ([]*Entity, []error) {
 	if err != nil {
 		return nil, []error{err}
 	}
+	//entities that were renamed are not orphaned (their images will be moved
+	//to the new entity ID during `apply`)
+	renamedIDs := make(map[string]bool)
+	for _, entity := range entities {
+		_, previousNames := NamesOf(entity.Definition)
+		for _, name := range previousNames {
+			renamedIDs[NewDefinitionLike(entity.Definition, name).EntityID()] = true
+		}
+	}
 	for _, id := range ids {
+		if renamedIDs[id] {
+			continue
+		}
 		var def EntityDefinition
 		switch {
 		case strings.HasPrefix(id, "group:"):
@@ -89,23 +94,50 @@ func Scan() ([]*Entity, []error) {
 		}
 	}
 
-	//flatten result into a list sorted by EntityID and filter invalid entities
+	//flatten result into a list sorted by apply order and filter invalid entities
 	result := make([]*Entity, 0, len(entities))
 	for _, entity := range entities {
 		if !entity.IsBroken {
 			result = append(result, entity)
 		}
 	}
-	sort.Sort(entitiesByName(result))
+	sort.Sort(entitiesByApplyOrder(result))
 
 	return result, errors
 }
 
-type entitiesByName []*Entity
+//findDefinitionFiles returns the paths of all entity definition files in the
+//resource directory, in the order in which they are read.
+func findDefinitionFiles() ([]string, error) {
+	dirPath := os.Getenv("HOLO_RESOURCE_DIR")
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
 
-func (e entitiesByName) Len() int      { return len(e) }
-func (e entitiesByName) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
-func (e entitiesByName) Less(i, j int) bool {
+	var paths []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".toml") {
+			paths = append(paths, filepath.Join(dirPath, fi.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+type entitiesByApplyOrder []*Entity
+
+func (e entitiesByApplyOrder) Len() int      { return len(e) }
+func (e entitiesByApplyOrder) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entitiesByApplyOrder) Less(i, j int) bool {
+	if oi, oj := e[i].ApplyOrder(), e[j].ApplyOrder(); oi != oj {
+		return oi < oj
+	}
 	return e[i].Definition.EntityID() < e[j].Definition.EntityID()
 }
 
@@ -148,6 +180,8 @@ func readDefinitionFile(definitionPath string, entities *map[string]*Entity) err
 	for idx, group := range contents.Group {
 		if group.Name == "" {
 			errors = append(errors, fmt.Errorf("groups[%d] is missing required 'name' attribute", idx))
+		} else if containsName(group.RenamedFrom, group.Name) {
+			errors = append(errors, fmt.Errorf("group %s has invalid 'renamedFrom' attribute (cannot contain its own name)", group.Name))
 		} else {
 			defs = append(defs, group)
 		}
@@ -156,6 +190,10 @@ func readDefinitionFile(definitionPath string, entities *map[string]*Entity) err
 		if user.Name == "" {
 			errors = append(errors, fmt.Errorf("users[%d] is missing required 'name' attribute", idx))
 			continue
+		}
+		userErrors := user.validate()
+		if len(userErrors) > 0 {
+			errors = append(errors, userErrors...)
 		} else {
 			defs = append(defs, user)
 		}
@@ -188,6 +226,81 @@ func readDefinitionFile(definitionPath string, entities *map[string]*Entity) err
 	return nil
 }
 
+//reconcileMemberships handles group members that are also defined as user
+//entities: Their membership is moved into the user definition's auxiliary
+//groups, since the user entity would otherwise remove the membership again
+//(and since the user may not exist yet when the group is applied).
+func reconcileMemberships(entities map[string]*Entity) (errors []error) {
+	for _, entity := range entities {
+		group, ok := entity.Definition.(*GroupDefinition)
+		if !ok || entity.IsBroken || len(group.Members) == 0 {
+			continue
+		}
+
+		var remainingMembers []string
+		for _, member := range group.Members {
+			userEntity, exists := entities["user:"+member]
+			if !exists || userEntity.IsBroken {
+				remainingMembers = append(remainingMembers, member)
+				continue
+			}
+			declared := &UserDefinition{Name: member, Groups: []string{group.Name}}
+			mergedDef, mergeErrors := declared.Merge(userEntity.Definition, MergeWhereCompatible, SkipDisabled)
+			if len(mergeErrors) == 0 {
+				userEntity.Definition = mergedDef
+			} else {
+				errors = append(errors, &FileInvalidError{entity.DefinitionFiles[0], mergeErrors})
+				userEntity.IsBroken = true
+			}
+		}
+		group.Members = remainingMembers
+	}
+	return errors
+}
+
+//validate checks the attributes of a user definition that cannot be checked
+//by the TOML decoder.
+func (u *UserDefinition) validate() (errors []error) {
+	if strings.ContainsAny(u.Password, ":\n") {
+		errors = append(errors, fmt.Errorf("user %s has invalid 'password' attribute (must be a crypt(3) hash)", u.Name))
+	} else if strings.HasPrefix(u.Password, "!") {
+		errors = append(errors, fmt.Errorf("user %s has invalid 'password' attribute (use the 'locked' attribute to lock the account)", u.Name))
+	}
+	if u.Expires != "" {
+		if _, err := dateToShadowDays(u.Expires); err != nil {
+			errors = append(errors, fmt.Errorf("user %s has %s", u.Name, err.Error()))
+		}
+	}
+	if u.HomeMode != "" {
+		if _, err := parseHomeMode(u.HomeMode); err != nil {
+			errors = append(errors, fmt.Errorf("user %s has %s", u.Name, err.Error()))
+		}
+	}
+	if u.Skel != "" && !filepath.IsAbs(u.Skel) {
+		errors = append(errors, fmt.Errorf("user %s has invalid 'skel' attribute (must be an absolute path)", u.Name))
+	}
+	for _, value := range u.SubUIDs {
+		if _, _, err := parseSubIDRange(value); err != nil {
+			errors = append(errors, fmt.Errorf("user %s has invalid 'subUIDs' attribute: %s", u.Name, err.Error()))
+		}
+	}
+	for _, value := range u.SubGIDs {
+		if _, _, err := parseSubIDRange(value); err != nil {
+			errors = append(errors, fmt.Errorf("user %s has invalid 'subGIDs' attribute: %s", u.Name, err.Error()))
+		}
+	}
+	if containsName(u.RenamedFrom, u.Name) {
+		errors = append(errors, fmt.Errorf("user %s has invalid 'renamedFrom' attribute (cannot contain its own name)", u.Name))
+	}
+	if u.MaxAge != nil && *u.MaxAge < -1 {
+		errors = append(errors, fmt.Errorf("user %s has invalid 'maxAge' attribute (must be -1 or greater)", u.Name))
+	}
+	if u.Inactive != nil && *u.Inactive < -1 {
+		errors = append(errors, fmt.Errorf("user %s has invalid 'inactive' attribute (must be -1 or greater)", u.Name))
+	}
+	return errors
+}
+
 //Migration path for the old registry at `/var/lib/holo/users-groups/state.toml`.
 func migrateOldRegistry() error {
 	//read state.toml (if it exists)
@@ -0,0 +1,138 @@
+/*******************************************************************************
+*
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
+*
+* This file is part of Holo.
+*
+* Holo is free software: you can redistribute it and/or modify it under the
+* terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* Holo is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* Holo. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package entrypoint
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//parseSubIDRange parses a range of subordinate IDs in the format
+//"FIRST-LAST" (the format that usermod(8) takes for --add-subuids).
+func parseSubIDRange(value string) (first, count int, err error) {
+	fields := strings.SplitN(value, "-", 2)
+	if len(fields) == 2 {
+		var last int
+		first, err = strconv.Atoi(fields[0])
+		if err == nil {
+			last, err = strconv.Atoi(fields[1])
+		}
+		if err == nil && first >= 0 && last >= first {
+			return first, last - first + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid range %q (must look like \"100000-165535\")", value)
+}
+
+//formatSubIDRange is the inverse of parseSubIDRange.
+func formatSubIDRange(first, count int) string {
+	return fmt.Sprintf("%d-%d", first, first+count-1)
+}
+
+//subIDRangeOf returns the range described by an entry in /etc/subuid or
+///etc/subgid, which has the format "USER:FIRST:COUNT".
+func subIDRangeOf(fields []string) (string, error) {
+	if len(fields) < 3 {
+		return "", fmt.Errorf("not enough fields")
+	}
+	first, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", err
+	}
+	count, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", err
+	}
+	return formatSubIDRange(first, count), nil
+}
+
+//readSubIDRanges reads the subordinate ID ranges of the given user from
+///etc/subuid or /etc/subgid (where the user can be given by name or by UID). A
+//missing file is treated like an empty file.
+func readSubIDRanges(databaseFile, userName, uid string) ([]string, error) {
+	entries, err := GetentAll(databaseFile, func(fields []string) bool {
+		return fields[0] == userName || fields[0] == uid
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var result []string
+	for _, fields := range entries {
+		value, err := subIDRangeOf(fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry in %s (%s)", databaseFile, err.Error())
+		}
+		result = append(result, value)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+//setSubIDRanges edits the ranges of the user in the given database
+//(/etc/subuid or /etc/subgid), by adding the desired ranges that are missing,
+//and by removing the currently provisioned ranges that are not desired.
+func setSubIDRanges(db *etcDatabase, userName, uid string, desired, provisioned []string) error {
+	isOwner := func(fields []string) bool { return fields[0] == userName || fields[0] == uid }
+
+	_, removed := diffNames(desired, provisioned)
+	for _, value := range removed {
+		db.removeWhere(3, func(fields []string) bool {
+			current, err := subIDRangeOf(fields)
+			return err == nil && isOwner(fields) && current == value
+		})
+	}
+
+	for _, value := range desired {
+		first, count, err := parseSubIDRange(value)
+		if err != nil {
+			return err
+		}
+		//check if the range is present already, or overlaps with the range of
+		//another user
+		present := false
+		var conflict error
+		db.each(3, func(fields []string) []string {
+			current, err := subIDRangeOf(fields)
+			if err != nil {
+				return nil
+			}
+			if isOwner(fields) {
+				present = present || current == value
+				return nil
+			}
+			otherFirst, otherCount, _ := parseSubIDRange(current)
+			if first < otherFirst+otherCount && otherFirst < first+count {
+				conflict = fmt.Errorf("range %s overlaps with range %s of %s in %s", value, current, fields[0], db.path)
+			}
+			return nil
+		})
+		if conflict != nil {
+			return conflict
+		}
+		if !present {
+			db.add([]string{userName, strconv.Itoa(first), strconv.Itoa(count)})
+		}
+	}
+	return nil
+}
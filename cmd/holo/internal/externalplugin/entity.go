@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -36,6 +37,7 @@ import (
 // Entity is merely this package's implementation of holo.Entity.
 type Entity struct {
 	id           string
+	order        int
 	actionVerb   string
 	actionReason string
 	sourceFiles  []string
@@ -43,7 +43,7 @@ type Plugin struct {
 	runtime        holo.Runtime
 }
 
-var _ holo.Plugin = &Plugin{}
+var _ holo.RollbackPlugin = &Plugin{}
 
 // NewExternalPlugin creates a new Plugin that is implemented in a
 // separate executable.
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -31,7 +32,7 @@ import (
 
 func (p *Plugin) HoloInfo() map[string]string {
 	var stdout bytes.Buffer
-	err := p.command([]string{"info"}, &stdout, nil, nil).Run()
+	err := p.command([]string{"info"}, &stdout, output.Stderr, nil).Run()
 	if err != nil {
 		return nil
 	}
@@ -55,23 +56,40 @@ func (p *Plugin) HoloApply(entityID string, withForce bool, stdout, stderr io.Wr
 	}
 
 	// execute apply operation
-	fd3text, err := p.runCommandWithFD3([]string{op, entityID}, stdout, stderr)
+	return p.runApplyLikeOperation([]string{op, entityID}, stdout, stderr)
+}
+
+func (p *Plugin) HoloRollback(entityID, timestamp string, stdout, stderr io.Writer) holo.ApplyResult {
+	args := []string{"rollback", entityID}
+	if timestamp != "" {
+		args = append(args, timestamp)
+	}
+	return p.runApplyLikeOperation(args, stdout, stderr)
+}
+
+// runApplyLikeOperation runs an operation that reports its result in
+// the same way as the "apply" operation.
+func (p *Plugin) runApplyLikeOperation(args []string, stdout, stderr io.Writer) holo.ApplyResult {
+	errDetector := &errorDetector{Writer: stderr}
+	fd3text, err := p.runCommandWithFD3(args, stdout, errDetector)
 	if err != nil {
-		output.Errorf(stderr, err.Error())
+		// a generic "exit status 1" does not add anything if the
+		// plugin already reported what went wrong
+		if !errDetector.sawError {
+			output.Errorf(stderr, err.Error())
+		}
 		return holo.ApplyError(1)
 	}
 
 	var result holo.ApplyResult = holo.ApplyApplied
-	if err == nil {
-		for _, line := range strings.Split(fd3text, "\n") {
-			switch line {
-			case "not changed":
-				result = holo.ApplyAlreadyApplied
-			case "requires --force to overwrite":
-				result = holo.ApplyExternallyChanged
-			case "requires --force to restore":
-				result = holo.ApplyExternallyDeleted
-			}
+	for _, line := range strings.Split(fd3text, "\n") {
+		switch line {
+		case "not changed":
+			result = holo.ApplyAlreadyApplied
+		case "requires --force to overwrite":
+			result = holo.ApplyExternallyChanged
+		case "requires --force to restore":
+			result = holo.ApplyExternallyDeleted
 		}
 	}
 	return result
@@ -93,3 +111,44 @@ func (p *Plugin) HoloDiff(entityID string, stderr io.Writer) (string, string) {
 
 	return filenames[0], filenames[1]
 }
+
+// errorDetector is an io.Writer that forwards to another io.Writer, and
+// notices when an error message (a line starting with "!!") is written.
+// ANSI escape sequences at the start of a line are skipped, since the
+// plugin's stderr has already been colorized when it gets here.
+type errorDetector struct {
+	Writer   io.Writer
+	sawError bool
+	//the first bytes of the current line (up to 2)
+	lineStart []byte
+	//whether lineStart is complete
+	midLine bool
+	//whether we are inside an escape sequence at the start of the line
+	inEscape bool
+}
+
+//Write implements the io.Writer interface.
+func (d *errorDetector) Write(p []byte) (n int, e error) {
+	for _, c := range p {
+		switch {
+		case c == '\n':
+			d.lineStart = d.lineStart[:0]
+			d.midLine = false
+			d.inEscape = false
+		case d.midLine:
+			continue
+		case c == '\x1b':
+			d.inEscape = true
+		case d.inEscape:
+			//an escape sequence ends with a letter (e.g. "\x1b[1;31m")
+			d.inEscape = c == '[' || c < 0x40 || c > 0x7e
+		default:
+			d.lineStart = append(d.lineStart, c)
+			if len(d.lineStart) == 2 {
+				d.sawError = d.sawError || string(d.lineStart) == "!!"
+				d.midLine = true
+			}
+		}
+	}
+	return d.Writer.Write(p)
+}
@@ -1,6 +1,7 @@
 /*******************************************************************************
 *
 * Copyright 2015 Stefan Majewsky <majewsky@gmx.net>
+* Copyright 2018 Luke Shumaker <lukeshu@parabola.nu>
 *
 * This file is part of Holo.
 *
@@ -26,6 +27,7 @@ import (
 	"io"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/holocm/holo/lib/holo"
@@ -87,6 +89,11 @@ func (p *Plugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
 			result = append(result, currentEntity)
 		case "SOURCE":
 			currentEntity.sourceFiles = append(currentEntity.sourceFiles, value)
+		case "ORDER":
+			currentEntity.order, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid ORDER value \"%s\"", errorIntro, value)
+			}
 		case "ACTION":
 			// parse action verb/reason
 			currentEntity.actionVerb, currentEntity.actionReason = scanParseAction(value)
@@ -96,12 +103,19 @@ func (p *Plugin) HoloScan(stderr io.Writer) ([]holo.Entity, error) {
 		}
 	}
 
-	sort.Sort(entitiesByID(result))
+	sort.Sort(entitiesByOrder(result))
 	return result, nil
 }
 
-type entitiesByID []holo.Entity
+type entitiesByOrder []holo.Entity
 
-func (e entitiesByID) Len() int           { return len(e) }
-func (e entitiesByID) Less(i, j int) bool { return e[i].EntityID() < e[j].EntityID() }
-func (e entitiesByID) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entitiesByOrder) Len() int      { return len(e) }
+func (e entitiesByOrder) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entitiesByOrder) Less(i, j int) bool {
+	// entities are sorted by the order requested by the plugin first
+	oi, oj := e[i].(*Entity).order, e[j].(*Entity).order
+	if oi != oj {
+		return oi < oj
+	}
+	return e[i].EntityID() < e[j].EntityID()
+}
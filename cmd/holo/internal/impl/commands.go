@@ -28,15 +28,49 @@ import (
 )
 
 func CommandApply(entities []*EntityHandle, withForce bool) int {
+	failed := 0
 	for _, entity := range entities {
-		entity.Apply(withForce)
+		if entity.Apply(withForce).ExitCode() != 0 {
+			failed++
+		}
 
 		os.Stderr.Sync()
 		output.Stdout.EndParagraph()
 		os.Stdout.Sync()
 	}
 
-	return 0
+	return summarizeFailures(failed, "applied")
+}
+
+func CommandRollback(entities []*EntityHandle, timestamp string) int {
+	failed := 0
+	for _, entity := range entities {
+		if entity.Rollback(timestamp).ExitCode() != 0 {
+			failed++
+		}
+
+		os.Stderr.Sync()
+		output.Stdout.EndParagraph()
+		os.Stdout.Sync()
+	}
+
+	return summarizeFailures(failed, "rolled back")
+}
+
+// summarizeFailures reports how many entities could not be processed
+// by CommandApply or CommandRollback, and returns the exit code for
+// the command.
+func summarizeFailures(failed int, participle string) int {
+	if failed == 0 {
+		return 0
+	}
+	if failed == 1 {
+		output.Errorf(output.Stderr, "1 entity could not be %s", participle)
+	} else {
+		output.Errorf(output.Stderr, "%d entities could not be %s", failed, participle)
+	}
+	os.Stderr.Sync()
+	return 1
 }
 
 func CommandScan(entities []*EntityHandle, isPorcelain, isShort bool) int {
@@ -49,7 +49,9 @@ func (ehandle *EntityHandle) MatchesSelector(value string) bool {
 	return false
 }
 
-func (ehandle *EntityHandle) Apply(withForce bool) {
+// Apply provisions the entity, and returns the result reported by the
+// plugin.
+func (ehandle *EntityHandle) Apply(withForce bool) holo.ApplyResult {
 	// track whether the report was already printed
 	tracker := &output.PrologueTracker{Printer: func() { ehandle.PrintReport(true) }}
 	stdout := &output.PrologueWriter{Tracker: tracker, Writer: output.Stdout}
@@ -86,7 +88,7 @@ func (ehandle *EntityHandle) Apply(withForce bool) {
 		diff, err := ehandle.RenderDiff()
 		if err != nil {
 			output.Errorf(stderr, err.Error())
-			return
+			return result
 		}
 		// indent diff
 		indent := []byte("    ")
@@ -97,6 +99,29 @@ func (ehandle *EntityHandle) Apply(withForce bool) {
 		output.Stdout.EndParagraph()
 		output.Stdout.Write(diff)
 	}
+	return result
+}
+
+// Rollback restores the entity from the backup with the given
+// timestamp (or from the most recent backup, if the timestamp is
+// empty), and returns the result reported by the plugin.
+func (ehandle *EntityHandle) Rollback(timestamp string) holo.ApplyResult {
+	// track whether the report was already printed
+	tracker := &output.PrologueTracker{Printer: func() { ehandle.PrintReport(true) }}
+	stdout := &output.PrologueWriter{Tracker: tracker, Writer: output.Stdout}
+	stderr := &output.PrologueWriter{Tracker: tracker, Writer: output.Stderr}
+
+	plugin, ok := ehandle.PluginHandle.Plugin.(holo.RollbackPlugin)
+	if !ok || ehandle.PluginHandle.Info["SUPPORTS_ROLLBACK"] != "1" {
+		output.Errorf(stderr, "plugin holo-%s does not support rollback", ehandle.PluginHandle.ID)
+		return holo.ApplyError(1)
+	}
+
+	result := plugin.HoloRollback(ehandle.Entity.EntityID(), timestamp, stdout, stderr)
+	if result == holo.ApplyApplied {
+		tracker.Exec()
+	}
+	return result
 }
 
 // PrintReport prints the scan report describing this Entity.
@@ -33,6 +33,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/holocm/holo/cmd/holo/internal/output"
 )
@@ -75,8 +76,8 @@ import (
 // selectors)"; alternatively, you can loop over your entities and
 // selectors calling entityHandle.MatchesSelector(selector) for each.
 //
-// 6. Call one of "CommandApply", "CommandDiff", or "CommandScan" with
-// your list of entities.
+// 6. Call one of "CommandApply", "CommandDiff", "CommandRollback", or
+// "CommandScan" with your list of entities.
 //
 // Beware that you should probably have a system-wide mutex/lockfile,
 // ensuring that only one CommandApply is running on a system at once!
@@ -84,8 +85,8 @@ import (
 // AcquirePidFile(), and calling pidFile.Release() when done.
 //
 // Alternatively, you can loop over the list of entities yourself,
-// calling ".Apply()", ".PrintReport()", ".PrintScanReport()", or
-// ".RenderDiff()" on each.
+// calling ".Apply()", ".Rollback()", ".PrintReport()",
+// ".PrintScanReport()", or ".RenderDiff()" on each.
 //
 // 7. Call "runtimeManager.Close()" to clean up.
 //
@@ -98,6 +99,7 @@ func Main(rootDir, version string, getPlugin PluginGetter) (exitCode int) {
 		optionApplyForce = iota
 		optionScanShort
 		optionScanPorcelain
+		optionRollbackTo
 	)
 
 	var runtimeManager *RuntimeManager
@@ -107,6 +109,7 @@ func Main(rootDir, version string, getPlugin PluginGetter) (exitCode int) {
 		fmt.Fprintf(w, "Usage: %s apply [-f|--force] [selector ...]\n", program)
 		fmt.Fprintf(w, "   or: %s diff [selector ...]\n", program)
 		fmt.Fprintf(w, "   or: %s scan [-s|--short|-p|--porcelain] [selector ...]\n", program)
+		fmt.Fprintf(w, "   or: %s rollback [--to=timestamp] selector ...\n", program)
 		fmt.Fprintf(w, "   or: %s version\n", program)
 		fmt.Fprintf(w, "   or: %s help\n", program)
 		fmt.Fprintf(w, "\nSee `man 8 holo` for details.\n")
@@ -121,6 +124,9 @@ func Main(rootDir, version string, getPlugin PluginGetter) (exitCode int) {
 	//check that it is a known command word
 	var command func([]*EntityHandle, map[int]bool) int
 	knownOpts := make(map[string]int)
+	knownValueOpts := make(map[string]int)
+	optionValues := make(map[int]string)
+	needsSelector := false
 	switch os.Args[1] {
 	case "apply":
 		knownOpts = map[string]int{"-f": optionApplyForce, "--force": optionApplyForce}
@@ -144,6 +150,17 @@ func Main(rootDir, version string, getPlugin PluginGetter) (exitCode int) {
 		command = func(e []*EntityHandle, options map[int]bool) int {
 			return CommandScan(e, options[optionScanPorcelain], options[optionScanShort])
 		}
+	case "rollback":
+		knownValueOpts = map[string]int{"--to": optionRollbackTo}
+		needsSelector = true
+		command = func(e []*EntityHandle, options map[int]bool) int {
+			pidFile := AcquirePidFile(filepath.Join(rootDir, "run/holo.pid"))
+			if pidFile == nil {
+				return 255
+			}
+			defer pidFile.Release()
+			return CommandRollback(e, optionValues[optionRollbackTo])
+		}
 	case "version", "--version":
 		fmt.Println(version)
 		return 0
@@ -189,9 +206,21 @@ func Main(rootDir, version string, getPlugin PluginGetter) (exitCode int) {
 			// either it's a known option for this subcommand...
 			if value, ok := knownOpts[arg]; ok {
 				options[value] = true
-			} else { // ...or it must be a selector
-				selectors[arg] = false
+				continue
+			}
+			// ...or a known option with a value ("--name=value")...
+			if idx := strings.Index(arg, "="); idx > 0 {
+				if value, ok := knownValueOpts[arg[:idx]]; ok {
+					optionValues[value] = arg[idx+1:]
+					continue
+				}
 			}
+			// ...or it must be a selector
+			selectors[arg] = false
+		}
+		if needsSelector && len(selectors) == 0 {
+			output.Errorf(output.Stderr, "%s: at least one selector must be given", os.Args[1])
+			return 255
 		}
 
 		// ask all plugins to scan for entities
@@ -22,7 +22,10 @@ package impl
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
@@ -42,6 +45,18 @@ func renderFileDiff(fromPath, toPath string) ([]byte, error) {
 		return nil, err
 	}
 
+	//binary files are not diffed by git-diff (which would load them into
+	//memory completely); only their digests are shown
+	for _, path := range []string{fromPathToUse, toPathToUse} {
+		isBinary, err := isBinaryFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if isBinary {
+			return renderBinaryFileDiff(fromPath, fromPathToUse, toPath, toPathToUse)
+		}
+	}
+
 	//run git-diff to obtain the diff
 	var buffer bytes.Buffer
 	cmd := exec.Command("git", "diff", "--no-index", "--", fromPathToUse, toPathToUse)
@@ -78,19 +93,47 @@ func renderFileDiff(fromPath, toPath string) ([]byte, error) {
 	rx = regexp.MustCompile(`(?m:^\+\+\+ b/.*$)`)
 	result = rx.ReplaceAll(result, []byte("+++ "+toPath))
 
-	//colorize diff
-	rules := []colorize.LineColorizingRule{
-		{[]byte("diff "), []byte("\x1B[1m")},
-		{[]byte("new "), []byte("\x1B[1m")},
-		{[]byte("deleted "), []byte("\x1B[1m")},
-		{[]byte("--- "), []byte("\x1B[1m")},
-		{[]byte("+++ "), []byte("\x1B[1m")},
-		{[]byte("@@ "), []byte("\x1B[36m")},
-		{[]byte("-"), []byte("\x1B[31m")},
-		{[]byte("+"), []byte("\x1B[32m")},
+	return colorize.ColorizeLines(result, diffColorizingRules), nil
+}
+
+//renderBinaryFileDiff is the part of renderFileDiff for binary files.
+func renderBinaryFileDiff(fromPath, fromPathToUse, toPath, toPathToUse string) ([]byte, error) {
+	fromDigest, err := fileDigest(fromPathToUse)
+	if err != nil {
+		return nil, err
+	}
+	toDigest, err := fileDigest(toPathToUse)
+	if err != nil {
+		return nil, err
+	}
+	if fromDigest == toDigest {
+		return nil, nil
 	}
 
-	return colorize.ColorizeLines(result, rules), nil
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "diff --holo %s %s\n", fromPath, toPath)
+	fmt.Fprintf(&buffer, "Binary files %s and %s differ\n", fromPath, toPath)
+	if fromDigest != "" {
+		fmt.Fprintf(&buffer, "-sha256 %s\n", fromDigest)
+	}
+	if toDigest != "" {
+		fmt.Fprintf(&buffer, "+sha256 %s\n", toDigest)
+	}
+
+	return colorize.ColorizeLines(buffer.Bytes(), diffColorizingRules), nil
+}
+
+//diffColorizingRules is used to colorize the output of renderFileDiff.
+var diffColorizingRules = []colorize.LineColorizingRule{
+	{[]byte("diff "), []byte("\x1B[1m")},
+	{[]byte("new "), []byte("\x1B[1m")},
+	{[]byte("deleted "), []byte("\x1B[1m")},
+	{[]byte("Binary "), []byte("\x1B[1m")},
+	{[]byte("--- "), []byte("\x1B[1m")},
+	{[]byte("+++ "), []byte("\x1B[1m")},
+	{[]byte("@@ "), []byte("\x1B[36m")},
+	{[]byte("-"), []byte("\x1B[31m")},
+	{[]byte("+"), []byte("\x1B[32m")},
 }
 
 func checkFile(path string) (pathToUse string, returnError error) {
@@ -120,3 +163,50 @@ func checkFile(path string) (pathToUse string, returnError error) {
 	}
 
 }
+
+//isBinaryFile uses the same heuristic as Git to decide whether a file is
+//binary: it is if there is a NUL byte within the first 8000 bytes. Symlinks
+//are never considered binary.
+func isBinaryFile(path string) (bool, error) {
+	if path == "/dev/null" {
+		return false, nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	buf := make([]byte, 8000)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.IndexByte(buf[:n], 0) != -1, nil
+}
+
+//fileDigest returns the hex-encoded SHA-256 digest of the given file, or an
+//empty string for /dev/null.
+func fileDigest(path string) (string, error) {
+	if path == "/dev/null" {
+		return "", nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
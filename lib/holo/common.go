@@ -94,6 +94,25 @@ type Plugin interface {
 	HoloDiff(entityID string, stderr io.Writer) (string, string)
 }
 
+// RollbackPlugin is an optional extension of the Plugin interface for
+// plugins that keep backups of entities whose external changes were
+// overwritten by a forced apply, and that can restore these backups.
+//
+// A plugin that implements this interface shall also report
+// "SUPPORTS_ROLLBACK=1" in its HoloInfo.
+type RollbackPlugin interface {
+	Plugin
+
+	// HoloRollback restores the entity with the given ID from the
+	// backup with the given timestamp.  If the timestamp is
+	// empty, the most recent backup shall be restored.
+	//
+	// Informational output should be printed on the `stdout`
+	// Writer, and errors and warnings should be printed on the
+	// `stderr` Writer.
+	HoloRollback(entityID, timestamp string, stdout, stderr io.Writer) ApplyResult
+}
+
 // KV is a simple struct for storing a key/value pair.  A list of
 // these is useful in place of a map for instances where there may be
 // duplicate keys, or when order matters.
@@ -97,6 +97,21 @@ func Main(getplugin func(holo.Runtime) holo.Plugin) int {
 			msg.Send()
 		}
 		return result.ExitCode()
+	case "rollback":
+		rp, ok := plugin.(holo.RollbackPlugin)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "!! this plugin does not support the rollback operation\n")
+			return 1
+		}
+		timestamp := ""
+		if len(os.Args) > 3 {
+			timestamp = os.Args[3]
+		}
+		result := rp.HoloRollback(os.Args[2], timestamp, os.Stdout, os.Stderr)
+		if msg, ok := result.(holo.ApplyMessage); ok {
+			msg.Send()
+		}
+		return result.ExitCode()
 	case "diff":
 		new, cur := plugin.HoloDiff(os.Args[2], os.Stderr)
 		if new == "" && cur == "" {
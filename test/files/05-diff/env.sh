@@ -0,0 +1,2 @@
+# fixed timestamp for the backups that are made by `holo apply --force`
+export HOLO_TEST_BACKUP_EPOCH=1500000000
@@ -0,0 +1,17 @@
+# fixed timestamp for the backup that is made by `holo apply --force`
+export HOLO_TEST_BACKUP_EPOCH=1500000000
+# the dump format cannot represent NUL bytes, so the binary files are created here
+mkdir -p target/usr/share/holo/files/01-firmware/etc target/var/lib/holo/files/base/etc target/var/lib/holo/files/provisioned/etc
+# new entity: resource replaces the target
+printf 'firmware\0v1\n' > target/etc/firmware.bin
+printf 'firmware\0v2\n' > target/usr/share/holo/files/01-firmware/etc/firmware.bin
+# provisioned entity that was modified by the user afterwards
+printf 'blob\0base\n'        > target/var/lib/holo/files/base/etc/blob-modified.bin
+printf 'blob\0provisioned\n' > target/var/lib/holo/files/provisioned/etc/blob-modified.bin
+printf 'blob\0provisioned\n' > target/usr/share/holo/files/01-firmware/etc/blob-modified.bin
+printf 'blob\0modified\n'    > target/etc/blob-modified.bin
+# provisioned entity that is unchanged
+printf 'blob\0base\n'        > target/var/lib/holo/files/base/etc/blob-unmodified.bin
+printf 'blob\0provisioned\n' > target/var/lib/holo/files/provisioned/etc/blob-unmodified.bin
+printf 'blob\0provisioned\n' > target/usr/share/holo/files/01-firmware/etc/blob-unmodified.bin
+printf 'blob\0provisioned\n' > target/etc/blob-unmodified.bin
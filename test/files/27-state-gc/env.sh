@@ -0,0 +1,9 @@
+# run `holo-files gc` right before `holo apply`
+holo_binary="$HOLO_BINARY"
+holo_wrapper() {
+	if [ "$1" = apply ]; then
+		../../holo-files gc || return $?
+	fi
+	"$holo_binary" "$@"
+}
+HOLO_BINARY=holo_wrapper
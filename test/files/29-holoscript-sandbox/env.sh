@@ -0,0 +1,7 @@
+# the sandbox needs namespaces (and user namespaces when not running as root),
+# which are not available everywhere (e.g. in some containers)
+if [ "$(id -u)" = 0 ]; then
+    unshare --mount --net --ipc --uts --pid --fork true 2>/dev/null
+else
+    unshare --user --map-root-user --mount --net --ipc --uts --pid --fork true 2>/dev/null
+fi || export HOLO_TEST_SKIP="namespaces are not supported in this environment"
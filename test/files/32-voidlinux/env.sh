@@ -0,0 +1,3 @@
+# the newer .new-* file is determined by mtime, not by name
+touch -d @1500000000 target/etc/targetfile-with-xbpsnew.conf.new-1.9_1
+touch -d @1500000100 target/etc/targetfile-with-xbpsnew.conf.new-1.10_1
@@ -0,0 +1,6 @@
+# fake dpkg tools that know about the packages in ./packages/
+export PATH="$PWD/bin:$PATH"
+# fixed timestamp for the backups that are made by `holo apply --force`
+export HOLO_TEST_BACKUP_EPOCH=1500000000
+# adopt the packaged version as target base after `holo apply --force` has only reported the difference
+export HOLO_TEST_COMMAND="../../holo-files adopt-base file:/etc/modified.conf"
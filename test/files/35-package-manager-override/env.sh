@@ -0,0 +1,2 @@
+# this distribution is not recognized, but it is derived from Arch Linux
+export HOLO_FILES_PACKAGE_MANAGER=arch
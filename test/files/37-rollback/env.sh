@@ -0,0 +1,4 @@
+# fixed timestamp for the backups that are made by `holo apply --force`
+export HOLO_TEST_BACKUP_EPOCH=1500000000
+# restore the latest backup of each entity (there is none for nobackup.conf)
+export HOLO_TEST_ROLLBACK="file:/etc/latest.conf file:/etc/collision.conf file:/etc/nobackup.conf"
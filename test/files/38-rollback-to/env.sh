@@ -0,0 +1,2 @@
+# restore an older backup (which only exists for first.conf)
+export HOLO_TEST_ROLLBACK="--to=20170103T000000Z file:/etc/first.conf file:/etc/second.conf"
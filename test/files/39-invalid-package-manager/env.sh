@@ -0,0 +1,2 @@
+# a typo in the package manager selection
+export HOLO_FILES_PACKAGE_MANAGER=arhc
@@ -0,0 +1,3 @@
+# these tests check the commands given to shadow-utils (which are only printed
+# instead of executed, since $HOLO_ROOT_DIR is not /)
+export HOLO_USERS_GROUPS_BACKEND=shadow-utils
@@ -0,0 +1,2 @@
+# the native backend writes a timestamp into /etc/shadow for new users
+export SOURCE_DATE_EPOCH=1500000000
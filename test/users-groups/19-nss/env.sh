@@ -0,0 +1,6 @@
+# the name services are simulated by a fake getent(1) in the target directory
+export HOLO_USERS_GROUPS_NSS=getent
+# (they are allowed here since HOLO_ROOT_DIR is not "/" during tests)
+export HOLO_USERS_GROUPS_NSS_FORCE=1
+export PATH="$PWD/target/usr/bin:$PATH"
+export SOURCE_DATE_EPOCH=1500000000
@@ -0,0 +1,3 @@
+# the name services of the running system must not be consulted for an image
+# root filesystem (unless $HOLO_USERS_GROUPS_NSS_FORCE is set)
+export HOLO_USERS_GROUPS_NSS=getent
@@ -15,7 +15,7 @@ _holo() {
 
     if [ "$COMP_CWORD" = 1 ]; then
         # autocomplete first argument (either a command verb or --help/--version)
-        COMPREPLY=( $(compgen -W "--help --version apply diff scan" -- "$CURRENT_WORD") )
+        COMPREPLY=( $(compgen -W "--help --version apply diff rollback scan" -- "$CURRENT_WORD") )
         return 0
     elif [ "${COMP_WORDS[1]}" = "apply" ]; then
         # autocomplete for "holo apply" - argument is either an entity or -f/--force
@@ -25,6 +25,10 @@ _holo() {
         # autocomplete for "holo diff" - argument is an entity
         COMPREPLY=( $(compgen -W "$(_holo_valid_selectors)" -- "$CURRENT_WORD") )
         return 0
+    elif [ "${COMP_WORDS[1]}" = "rollback" ]; then
+        # autocomplete for "holo rollback" - argument is an entity (timestamps for --to are not completed)
+        COMPREPLY=( $(compgen -W "$(_holo_valid_selectors)" -- "$CURRENT_WORD") )
+        return 0
     elif [ "${COMP_WORDS[1]}" = "scan" ]; then
         # autocomplete for "holo scan" - argument is either an entity or -p/--porcelain/-s/--short
         COMPREPLY=( $(compgen -W "$(_holo_valid_selectors) -p --porcelain -s --short" -- "$CURRENT_WORD") )